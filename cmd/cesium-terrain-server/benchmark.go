@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Benchmark measures the throughput and latency of tile requests for a
+// tileset, either directly against a store or against a running server.
+type Benchmark struct {
+	Tileset          string
+	MinZoom, MaxZoom uint64
+	Concurrency      int
+	Requests         int
+	Url              string        // the base terrain url of a server. If empty the store is used
+	Store            stores.Storer // the store used if no url is set
+}
+
+// The outcome of a benchmark run.
+type BenchmarkResult struct {
+	Elapsed   time.Duration
+	Latencies []time.Duration // sorted, fastest first
+	Found     int             // the number of requests returning a tile
+	Errors    int             // the number of failed requests
+}
+
+// ParseZoomRange parses a zoom level (`5`) or range of zoom levels (`0-5`),
+// neither of which can exceed stores.MAX_ZOOM.
+func ParseZoomRange(value string) (min, max uint64, err error) {
+	parts := strings.SplitN(value, "-", 2)
+	if _, err = fmt.Sscan(parts[0], &min); err != nil {
+		return
+	}
+
+	max = min
+	if len(parts) == 2 {
+		if _, err = fmt.Sscan(parts[1], &max); err != nil {
+			return
+		}
+	}
+
+	if max < min {
+		err = fmt.Errorf("bad zoom range %s", value)
+	} else if max > stores.MAX_ZOOM {
+		err = fmt.Errorf("bad zoom range %s: zoom levels can't exceed %d", value, stores.MAX_ZOOM)
+	}
+	return
+}
+
+// Return a random tile within the benchmark's zoom range.
+func (this *Benchmark) tile(rnd *rand.Rand) *stores.Terrain {
+	z := this.MinZoom + uint64(rnd.Int63n(int64(this.MaxZoom-this.MinZoom+1)))
+	return &stores.Terrain{
+		Z: z,
+		X: uint64(rnd.Int63n(int64(2) << z)), // twice as many columns as rows
+		Y: uint64(rnd.Int63n(int64(1) << z)),
+	}
+}
+
+// Request a tile, returning whether it was found.
+func (this *Benchmark) fetch(client *http.Client, t *stores.Terrain) (bool, error) {
+	if len(this.Url) == 0 {
+		err := this.Store.Tile(this.Tileset, t)
+		if err == stores.ErrNoItem {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	url := fmt.Sprintf("%s/%s/%d/%d/%d.terrain", strings.TrimRight(this.Url, "/"), this.Tileset, t.Z, t.X, t.Y)
+	res, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if _, err = io.Copy(ioutil.Discard, res.Body); err != nil {
+		return false, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusNoContent:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %s", url, res.Status)
+}
+
+// Run the benchmark.
+func (this *Benchmark) Run() *BenchmarkResult {
+	result := &BenchmarkResult{}
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: this.Concurrency},
+	}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	requests := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < this.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for range requests {
+				begin := time.Now()
+				found, err := this.fetch(client, this.tile(rnd))
+				latency := time.Since(begin)
+
+				lock.Lock()
+				result.Latencies = append(result.Latencies, latency)
+				if err != nil {
+					result.Errors++
+				} else if found {
+					result.Found++
+				}
+				lock.Unlock()
+			}
+		}(start.UnixNano() + int64(i))
+	}
+
+	for i := 0; i < this.Requests; i++ {
+		requests <- struct{}{}
+	}
+	close(requests)
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	sort.Slice(result.Latencies, func(i, j int) bool {
+		return result.Latencies[i] < result.Latencies[j]
+	})
+	return result
+}
+
+// Percentile returns the latency below which p percent of requests completed.
+func (this *BenchmarkResult) Percentile(p float64) time.Duration {
+	if len(this.Latencies) == 0 {
+		return 0
+	}
+
+	i := int(p / 100 * float64(len(this.Latencies)))
+	if i >= len(this.Latencies) {
+		i = len(this.Latencies) - 1
+	}
+	return this.Latencies[i]
+}
+
+// Write a report of the results.
+func (this *BenchmarkResult) Report(w io.Writer) {
+	count := len(this.Latencies)
+	fmt.Fprintf(w, "requests:   %d (%d found, %d errors)\n", count, this.Found, this.Errors)
+	fmt.Fprintf(w, "elapsed:    %s\n", this.Elapsed)
+	fmt.Fprintf(w, "throughput: %.1f requests/s\n", float64(count)/this.Elapsed.Seconds())
+	for _, p := range []float64{50, 90, 99, 100} {
+		fmt.Fprintf(w, "p%-9g %s\n", p, this.Percentile(p))
+	}
+}
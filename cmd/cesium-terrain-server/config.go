@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	myhandlers "github.com/geo-data/cesium-terrain-server/handlers"
+	"github.com/geo-data/cesium-terrain-server/stores/memcache"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+)
+
+// Config represents the JSON configuration file specified by the `-config`
+// option.
+type Config struct {
+	Tilesets myhandlers.Tilesets `json:"tilesets"` // per tileset configuration
+	Aliases  myhandlers.Aliases  `json:"aliases"`  // alternative tileset names
+
+	// Expiration times of tiles cached with `-memcache-store` by zoom level.
+	MemcacheTtls []ZoomTtl `json:"memcache_store_ttls"`
+}
+
+// ZoomTtl sets the expiration time of tiles in a range of zoom levels e.g.
+// `{"zooms": "6-12", "ttl": "1h"}`. The range can be open ended (`13+`) and a
+// ttl of `0` means tiles don't expire.
+type ZoomTtl struct {
+	Zooms string `json:"zooms"`
+	Ttl   string `json:"ttl"`
+}
+
+// ExpirationBands converts the memcache store ttls into expiration bands,
+// checking that their zoom ranges don't overlap.
+func (this *Config) ExpirationBands() (bands []memcache.ExpirationBand, err error) {
+	for _, zt := range this.MemcacheTtls {
+		var band memcache.ExpirationBand
+		if strings.HasSuffix(zt.Zooms, "+") {
+			band.MaxZoom = math.MaxUint64
+			_, err = fmt.Sscan(strings.TrimSuffix(zt.Zooms, "+"), &band.MinZoom)
+		} else {
+			band.MinZoom, band.MaxZoom, err = ParseZoomRange(zt.Zooms)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("memcache_store_ttls: bad zooms %s: %s", zt.Zooms, err)
+		}
+
+		ttl, err := time.ParseDuration(zt.Ttl)
+		if err != nil {
+			return nil, fmt.Errorf("memcache_store_ttls: bad ttl %s: %s", zt.Ttl, err)
+		}
+		band.Expiration = int32(ttl.Seconds())
+		bands = append(bands, band)
+	}
+
+	if err = memcache.ValidateBands(bands); err != nil {
+		err = fmt.Errorf("memcache_store_ttls: %s", err)
+		bands = nil
+	}
+	return
+}
+
+// LoadConfig reads a configuration file.
+func LoadConfig(filename string) (config *Config, err error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	config = &Config{}
+	if err = json.Unmarshal(body, config); err == nil {
+		err = config.Tilesets.Validate()
+	}
+	if err == nil {
+		_, err = config.ExpirationBands()
+	}
+
+	if err != nil {
+		config = nil
+	}
+	return
+}
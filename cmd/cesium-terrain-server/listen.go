@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const LISTEN_FDS_START = 3
+
+// Return the listener passed to the process by systemd socket activation, or
+// nil if the process was not socket activated. Only the first socket passed is
+// used.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil // the sockets are meant for another process
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(LISTEN_FDS_START, "LISTEN_FD_3")
+	defer file.Close() // the listener holds its own copy of the descriptor
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("bad socket activation file descriptor: %s", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prewarm loads tiles from a store, priming the caches in front of the origin
+// (e.g. memcache) before the server is sent traffic. Every tile of the low
+// zoom levels of tilesets is loaded, as are the tiles requested in an access
+// log.
+type Prewarm struct {
+	Tilesets         []string
+	MinZoom, MaxZoom uint64
+
+	// An access log in the combined log format written by the server,
+	// from which a sample of the requested tiles is loaded.
+	Log string
+	// The fraction of the tile requests in the log which are sampled.
+	LogFraction float64
+	// The base terrain url of the requests in the log.
+	BaseUrl string
+
+	Concurrency int
+	Store       stores.Storer
+}
+
+type prewarmTile struct {
+	tileset string
+	tile    stores.Terrain
+}
+
+// The request line of a tile request in the combined log format.
+var logRequest = regexp.MustCompile(`"(?:GET|HEAD) ([^ ?"]+)[^ "]* HTTP/[0-9.]+"`)
+
+// The path of a tile beneath the base terrain url.
+var logTilePath = regexp.MustCompile(`^/(.+)/([0-9]+)/([0-9]+)/([0-9]+)\.terrain$`)
+
+// Run the prewarm pass, returning the number of tiles loaded. Failures are
+// logged but don't stop the pass.
+func (this *Prewarm) Run() (loaded int64) {
+	tiles := make(chan prewarmTile)
+	var wg sync.WaitGroup
+	for i := 0; i < this.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				err := this.Store.Tile(t.tileset, &t.tile)
+				if err == nil {
+					atomic.AddInt64(&loaded, 1)
+				} else if err != stores.ErrNoItem {
+					log.Err(fmt.Sprintf("prewarm of %s/%d/%d/%d failed: %s", t.tileset, t.tile.Z, t.tile.X, t.tile.Y, err))
+				}
+			}
+		}()
+	}
+
+	// Zoom levels beyond stores.MAX_ZOOM are skipped so that the loop ends
+	// (and the tile ranges don't overflow) however high MaxZoom is.
+	for z := this.MinZoom; z <= this.MaxZoom && z <= stores.MAX_ZOOM && len(this.Tilesets) > 0; z++ {
+		for x := uint64(0); x < 2<<z; x++ { // twice as many columns as rows
+			for y := uint64(0); y < 1<<z; y++ {
+				for _, tileset := range this.Tilesets {
+					tiles <- prewarmTile{tileset, stores.Terrain{Z: z, X: x, Y: y}}
+				}
+			}
+		}
+	}
+
+	if len(this.Log) > 0 {
+		if err := this.replay(tiles); err != nil {
+			log.Err(fmt.Sprintf("cannot prewarm from %s: %s", this.Log, err))
+		}
+	}
+
+	close(tiles)
+	wg.Wait()
+	return
+}
+
+// Send a sample of the tiles requested in the access log, each at most once.
+func (this *Prewarm) replay(tiles chan<- prewarmTile) error {
+	file, err := os.Open(this.Log)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	prefix := strings.TrimRight(this.BaseUrl, "/")
+	seen := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if this.LogFraction < 1 && rnd.Float64() >= this.LogFraction {
+			continue
+		}
+
+		match := logRequest.FindStringSubmatch(scanner.Text())
+		if match == nil || !strings.HasPrefix(match[1], prefix+"/") {
+			continue
+		}
+		coords := logTilePath.FindStringSubmatch(strings.TrimPrefix(match[1], prefix))
+		if coords == nil {
+			continue
+		}
+
+		t := prewarmTile{tileset: coords[1]}
+		if err := t.tile.ParseCoord(coords[3], coords[4], coords[2]); err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%d/%d", t.tileset, t.tile.Z, t.tile.X, t.tile.Y)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		tiles <- t
+	}
+	return scanner.Err()
+}
+
+// Run the prewarm pass in the background, calling done when it completes.
+func (this *Prewarm) Start(done func()) {
+	go func() {
+		start := time.Now()
+		log.Notice("prewarming tiles")
+		loaded := this.Run()
+		log.Notice(fmt.Sprintf("prewarm loaded %d tiles in %s", loaded, time.Since(start)))
+		done()
+	}()
+}
@@ -0,0 +1,50 @@
+//go:build !windows && !plan9 && !nacl
+// +build !windows,!plan9,!nacl
+
+package main
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"io"
+	"log/syslog"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"mail":   syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// Route application logging at or above priority to syslog, returning a
+// writer which sends the access log to syslog at the info level.
+func setupSyslog(facility, tag string, priority log.Priority) (access io.Writer, err error) {
+	f, ok := facilities[facility]
+	if !ok {
+		err = fmt.Errorf("unknown syslog facility: %s", facility)
+		return
+	}
+
+	logger, err := syslog.New(f|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return
+	}
+
+	access, err = syslog.New(f|syslog.LOG_INFO, tag)
+	if err != nil {
+		return
+	}
+
+	log.SetLogger(log.Filter(logger, priority))
+	return
+}
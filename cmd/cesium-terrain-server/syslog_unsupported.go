@@ -0,0 +1,14 @@
+//go:build windows || plan9 || nacl
+// +build windows plan9 nacl
+
+package main
+
+import (
+	"errors"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"io"
+)
+
+func setupSyslog(facility, tag string, priority log.Priority) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
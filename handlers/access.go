@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The maximum number of tilesets whose access times are recorded.
+const MAX_ACCESS_TILESETS = 10000
+
+// AccessTimes records when each tileset was last requested, helping operators
+// identify tilesets that are no longer used. Only tilesets in the store are
+// recorded, as the names come from clients, and tilesets removed from the
+// store are forgotten when the times are saved. It is safe for concurrent use.
+type AccessTimes struct {
+	store stores.Storer
+	lock  sync.RWMutex
+	times map[string]time.Time
+	dirty bool // have times changed since they were last saved?
+}
+
+func NewAccessTimes(store stores.Storer) *AccessTimes {
+	return &AccessTimes{
+		store: store,
+		times: make(map[string]time.Time),
+	}
+}
+
+// Record a request for a tileset.
+func (this *AccessTimes) Record(tileset string) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	this.lock.RLock()
+	last, ok := this.times[tileset]
+	full := len(this.times) >= MAX_ACCESS_TILESETS
+	this.lock.RUnlock()
+
+	if (ok && !now.After(last)) || (!ok && full) {
+		return
+	}
+	if !ok && this.store.TilesetStatus(tileset) == stores.NOT_FOUND {
+		return
+	}
+
+	this.lock.Lock()
+	this.times[tileset] = now
+	this.dirty = true
+	this.lock.Unlock()
+}
+
+// Load access times saved by Persist, keeping any later times already
+// recorded.
+func (this *AccessTimes) Load(filename string) error {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]time.Time
+	if err = json.Unmarshal(body, &saved); err != nil {
+		return fmt.Errorf("bad access times in %s: %s", filename, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for tileset, t := range saved {
+		if last, ok := this.times[tileset]; !ok || t.After(last) {
+			this.times[tileset] = t
+		}
+	}
+	return nil
+}
+
+// Save the access times to a file, replacing it atomically. Tilesets no
+// longer in the store are forgotten.
+func (this *AccessTimes) Save(filename string) error {
+	this.lock.RLock()
+	var removed []string
+	for tileset := range this.times {
+		if this.store.TilesetStatus(tileset) == stores.NOT_FOUND {
+			removed = append(removed, tileset)
+		}
+	}
+	this.lock.RUnlock()
+
+	this.lock.Lock()
+	for _, tileset := range removed {
+		delete(this.times, tileset)
+	}
+	body, err := json.MarshalIndent(this.times, "", "  ")
+	this.dirty = false
+	this.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".access-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // fails harmlessly once renamed
+
+	if _, err = file.Write(body); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// Persist loads the access times saved in a file, if it exists, then saves
+// them to the file whenever they have changed, checking at an interval.
+func (this *AccessTimes) Persist(filename string, interval time.Duration) error {
+	if err := this.Load(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			this.lock.RLock()
+			dirty := this.dirty
+			this.lock.RUnlock()
+
+			if !dirty {
+				continue
+			}
+			if err := this.Save(filename); err != nil {
+				log.Err(fmt.Sprintf("cannot save tileset access times: %s", err))
+			}
+		}
+	}()
+	return nil
+}
+
+// An HTTP handler which returns the time each tileset was last requested as
+// JSON.
+func (this *AccessTimes) Handler(w http.ResponseWriter, r *http.Request) {
+	this.lock.RLock()
+	body, err := json.MarshalIndent(this.times, "", "  ")
+	this.lock.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Cache-Control", "no-store")
+	w.Write(body)
+}
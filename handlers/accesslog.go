@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	LOG_COMBINED      = "combined"      // the Apache combined log format
+	LOG_COMBINED_TIME = "combined-time" // combined, followed by the response time and tile source
+)
+
+type sourceKey struct{}
+
+// Record the source of a tile (e.g. the store which served it) for the access
+// log, if it is being recorded.
+func recordSource(r *http.Request, name string) {
+	if source, ok := r.Context().Value(sourceKey{}).(*string); ok {
+		*source = name
+	}
+}
+
+// Records the status and size of a response.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (this *loggingWriter) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+	}
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *loggingWriter) Write(buf []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(buf)
+	this.size += int64(n)
+	return n, err
+}
+
+// ReadFrom preserves the underlying writer's ability to send files with
+// sendfile.
+func (this *loggingWriter) ReadFrom(src io.Reader) (int64, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := this.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(this.ResponseWriter, src)
+	}
+	this.size += n
+	return n, err
+}
+
+func (this *loggingWriter) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Quote a request header for the log, escaping quotes and backslashes.
+func logQuote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// Return HTTP middleware which logs requests in the combined log format
+// followed by the time taken to respond, in seconds, and the source of the
+// tile e.g. `fs`, `blank` or `miss` (`-` if the response isn't a tile).
+func TimedLoggingHandler(out io.Writer, next http.Handler) http.Handler {
+	var lock sync.Mutex // serialises writes to out
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		source := "-"
+		lw := &loggingWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), sourceKey{}, &source)))
+		elapsed := time.Since(start)
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		user := "-"
+		if r.URL.User != nil && r.URL.User.Username() != "" {
+			user = r.URL.User.Username()
+		}
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %s %s %.3f %s\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.RequestURI, r.Proto, lw.status, lw.size,
+			logQuote(r.Referer()), logQuote(r.UserAgent()),
+			elapsed.Seconds(), source)
+
+		lock.Lock()
+		io.WriteString(out, line)
+		lock.Unlock()
+	})
+}
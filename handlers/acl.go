@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The query parameter in which clients which can't set headers present a key.
+const KEY_PARAM = "key"
+
+// Return the key presented by a client in an `Authorization: Bearer` header or
+// the KEY_PARAM query parameter.
+func requestKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get(KEY_PARAM)
+}
+
+// RestrictTilesets wraps a handler so that tilesets configured with keys are
+// only served to clients presenting one of them, others receiving a 401 if
+// they present no key or a 403 otherwise. The keys of the tilesets containing
+// a tileset also apply, so that e.g. `private/v3` is as restricted as
+// `private`. Tilesets without keys are public. Responses for restricted
+// tilesets are marked private so that shared caches, including memcached,
+// don't serve them to other clients.
+func RestrictTilesets(tilesets Tilesets, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tileset := TilesetName(r)
+		restrictions := tilesets.Restrictions(tileset)
+		if len(restrictions) == 0 {
+			handler(w, r)
+			return
+		}
+
+		key := requestKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, fmt.Sprintf("The tileset `%s` requires a key", tileset), http.StatusUnauthorized)
+			return
+		}
+
+		for _, keys := range restrictions {
+			if !authorized(key, keys) {
+				http.Error(w, fmt.Sprintf("The key is not authorized for the tileset `%s`", tileset), http.StatusForbidden)
+				return
+			}
+		}
+
+		w.Header().Set("Cache-Control", "private")
+		handler(w, r)
+	}
+}
+
+// Return whether a key is one of the keys of a tileset. Every key is compared
+// so that the time taken doesn't reveal which matched.
+func authorized(key string, keys []string) bool {
+	authorized := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// An HTTP handler which streams multiple tiles from a tileset as a
+// `multipart/mixed` response. The tiles are requested as a comma separated
+// list of `z/x/y` coordinates in the `tiles` query parameter, up to a maximum
+// of max tiles. Each tile is sent as soon as it is loaded so memory use is
+// independent of the batch size, and remaining tiles are abandoned if the
+// client disconnects. Missing tiles are omitted, other than root tiles which
+// are sent as blank tiles. Tiles are sent in the format configured for the
+// tileset.
+func BatchHandler(store stores.Storer, max int, config Tilesets) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tileset := TilesetName(r)
+		mediaType := config.Get(tileset).MediaType()
+		if store.TilesetStatus(tileset) == stores.NOT_FOUND {
+			http.Error(w,
+				fmt.Errorf("The tileset `%s` does not exist", tileset).Error(),
+				http.StatusNotFound)
+			return
+		}
+
+		// Parse all coordinates before responding so errors can be reported.
+		coords := strings.Split(r.URL.Query().Get("tiles"), ",")
+		if len(coords) > max {
+			http.Error(w, fmt.Sprintf("No more than %d tiles can be requested", max), http.StatusBadRequest)
+			return
+		}
+
+		tiles := make([]stores.Terrain, len(coords))
+		for i, coord := range coords {
+			zxy := strings.Split(coord, "/")
+			if len(zxy) != 3 {
+				http.Error(w, fmt.Sprintf("Bad tile coordinate `%s`: use z/x/y", coord), http.StatusBadRequest)
+				return
+			}
+
+			if err := tiles[i].ParseCoord(zxy[1], zxy[2], zxy[0]); err != nil {
+				http.Error(w, fmt.Sprintf("Bad tile coordinate `%s`: %s", coord, err), http.StatusBadRequest)
+				return
+			}
+			tiles[i].MediaType = mediaType
+		}
+
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		// Batches are unlikely to be requested again, and a cache serving
+		// the body without its boundary would corrupt it.
+		w.Header().Set("Cache-Control", "no-store")
+		flusher, _ := w.(http.Flusher)
+
+		for i := range tiles {
+			t := &tiles[i]
+			if err := r.Context().Err(); err != nil {
+				log.Debug(fmt.Sprintf("batch for %s abandoned: %s", tileset, err))
+				return
+			}
+
+			err := loadTile(r.Context(), store, tileset, t)
+			if err == stores.ErrNoItem && t.IsRoot() {
+				err = blankTile(t)
+			}
+			if err == stores.ErrNoItem {
+				continue
+			} else if err != nil {
+				// The status has been sent so the batch can only be cut short.
+				log.Err(fmt.Sprintf("batch for %s failed: %s", tileset, err))
+				return
+			}
+
+			body, _ := t.MarshalBinary()
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Type", t.MediaType)
+			header.Set("Content-Location", fmt.Sprintf("%d/%d/%d.terrain", t.Z, t.X, t.Y))
+			if encoding := sniffEncoding(body); encoding != "identity" {
+				header.Set("Content-Encoding", encoding)
+			}
+
+			part, err := mw.CreatePart(header)
+			if err == nil {
+				_, err = part.Write(body)
+			}
+			if err != nil {
+				return // the client has gone away
+			}
+
+			t.UnmarshalBinary(nil) // release the tile's memory
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		mw.Close()
+	}
+}
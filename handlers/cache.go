@@ -4,34 +4,120 @@ import (
 	"fmt"
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
+// CacheOptions configures how responses are saved to the cache.
+type CacheOptions struct {
+	// The number of goroutines saving responses in the background. If zero
+	// responses are saved synchronously after being sent.
+	Workers int
+	// The number of responses that can wait to be saved. Responses are
+	// dropped when the queue is full, keeping memory usage bounded.
+	QueueSize int
+	// Lowercase and trim the path of keys so that e.g. tileset names
+	// differing only in case share cache entries. The query string is left
+	// as it is, as its values (e.g. keys or signatures) may be case
+	// sensitive. This should match the case sensitivity of the store and any
+	// reverse proxy reading from the cache must normalise its keys in the
+	// same way. It doesn't apply to the tile keys of the memcache store.
+	NormalizeKeys bool
+	// The maximum number of idle connections kept open to each memcache
+	// server. Raising this improves connection reuse under high concurrency.
+	// If zero memcache.DefaultMaxIdleConns is used.
+	MaxIdleConns int
+	// The socket read/write timeout. If zero memcache.DefaultTimeout is used.
+	Timeout time.Duration
+}
+
 type Cache struct {
+	connstr string
 	mc      *memcache.Client
 	handler http.Handler
 	Limit   Bytes
 	limiter LimiterFactory
+	queue   chan *memcache.Item
+	options CacheOptions
 }
 
-func NewCache(connstr string, handler http.Handler, limit Bytes, limiter LimiterFactory) http.Handler {
-	return &Cache{
-		mc:      memcache.New(connstr),
+func NewCache(connstr string, handler http.Handler, limit Bytes, limiter LimiterFactory, options CacheOptions) *Cache {
+	mc := memcache.New(connstr)
+	mc.MaxIdleConns = options.MaxIdleConns
+	mc.Timeout = options.Timeout
+
+	cache := &Cache{
+		connstr: connstr,
+		mc:      mc,
 		handler: handler,
 		Limit:   limit,
 		limiter: limiter,
+		options: options,
+	}
+
+	if options.Workers > 0 {
+		cache.queue = make(chan *memcache.Item, options.QueueSize)
+		for i := 0; i < options.Workers; i++ {
+			go cache.worker()
+		}
+	}
+
+	return cache
+}
+
+// Save items from the queue until it is closed.
+func (this *Cache) worker() {
+	for item := range this.queue {
+		this.set(item)
+	}
+}
+
+func (this *Cache) set(item *memcache.Item) {
+	log.Debug(fmt.Sprintf("setting key: %s", item.Key))
+	if err := this.mc.Set(item); err != nil {
+		log.Err(err.Error())
 	}
 }
 
-func (this *Cache) generateKey(r *http.Request) string {
-	if key, ok := r.Header["X-Memcache-Key"]; ok {
-		return key[0]
+// Save an item to the cache, in the background if workers are available.
+func (this *Cache) save(item *memcache.Item) {
+	if this.queue == nil {
+		this.set(item)
+		return
 	}
 
-	// Use the request URI as a key.
-	url, _ := url.Parse(r.URL.String())
-	return url.RequestURI()
+	select {
+	case this.queue <- item:
+	default:
+		log.Notice(fmt.Sprintf("cache queue full: dropping key %s", item.Key))
+	}
+}
+
+func (this *Cache) generateKey(r *http.Request) (key string) {
+	if keys, ok := r.Header["X-Memcache-Key"]; ok {
+		key = keys[0]
+	} else {
+		// Use the request URI as a key.
+		url, _ := url.Parse(r.URL.String())
+		key = url.RequestURI()
+	}
+
+	if this.options.NormalizeKeys {
+		key = normalizeKey(key)
+	}
+	return
+}
+
+// Lowercase and trim the path of a cache key, leaving its query string intact.
+func normalizeKey(key string) string {
+	key = strings.TrimSpace(key)
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		return strings.ToLower(key[:i]) + key[i:]
+	}
+	return strings.ToLower(key)
 }
 
 func (this *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -51,8 +137,46 @@ func (this *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	tee := MultiWriter(w, recorder)
 	this.handler.ServeHTTP(tee, r)
 
-	// Only cache 200 responses.
-	if rec.Code != 200 {
+	// Only cache 200 responses to GET requests: HEAD responses have no body.
+	if rec.Code != 200 || r.Method != "GET" {
+		return
+	}
+
+	// Respect responses that must not be stored e.g. diagnostics, or shared
+	// e.g. tiles of restricted tilesets.
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+		return
+	}
+
+	// Tiles are cached by url but vary by the Accept header, so only the
+	// default representation is cached: other representations would be
+	// served to every client.
+	if varies(w.Header(), "Accept") && w.Header().Get("Content-Type") != stores.HEIGHTMAP_MEDIA_TYPE {
+		return
+	}
+
+	// Responses in encodings which most clients don't accept, such as
+	// precompressed brotli tiles, would be served to all clients.
+	encoding := w.Header().Get("Content-Encoding")
+	if encoding != "" && encoding != "gzip" {
+		return
+	}
+
+	// Nginx marks every cached tile as gzipped, so tiles sent uncompressed
+	// (e.g. small or empty tiles, or to clients not accepting gzip) must not
+	// be cached.
+	if strings.HasSuffix(r.URL.Path, ".terrain") && encoding != "gzip" {
+		return
+	}
+
+	// Nginx only marks `.terrain` urls as gzipped, so tiles requested in other
+	// formats by extension (e.g. `.qmesh`) are left to the terrain server.
+	if strings.HasSuffix(r.URL.Path, ".qmesh") {
+		return
+	}
+
+	// Stale tiles are served as a stopgap and shouldn't outlive the failure.
+	if w.Header().Get("Warning") != "" {
 		return
 	}
 
@@ -64,11 +188,33 @@ func (this *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Cache the response.
-	key := this.generateKey(r)
-	log.Debug(fmt.Sprintf("setting key: %s", key))
-	if err := this.mc.Set(&memcache.Item{Key: key, Value: rec.Body.Bytes()}); err != nil {
-		log.Err(err.Error())
+	this.save(&memcache.Item{Key: this.generateKey(r), Value: rec.Body.Bytes()})
+
+	return
+}
+
+// Return whether a response varies by a request header.
+func varies(headers http.Header, name string) bool {
+	for _, value := range headers["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
+// Describe implements the stores.Describer interface. The cache is healthy if
+// the memcache server responds to a request.
+func (this *Cache) Describe() (desc stores.Description) {
+	desc.Type = "memcache"
+	desc.Config = map[string]string{"servers": this.connstr}
+
+	if _, err := this.mc.Get("cesium-terrain-server/health"); err != nil && err != memcache.ErrCacheMiss {
+		desc.Error = err.Error()
+	} else {
+		desc.Healthy = true
+	}
 	return
 }
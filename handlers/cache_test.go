@@ -0,0 +1,18 @@
+package handlers
+
+import "testing"
+
+func TestNormalizeKey(t *testing.T) {
+	tests := map[string]string{
+		"/tilesets/SRTM/0/0/0.terrain":                 "/tilesets/srtm/0/0/0.terrain",
+		" /tilesets/SRTM/layer.json ":                  "/tilesets/srtm/layer.json",
+		"/tilesets/SRTM/0/0/0.terrain?key=AbC&sig=XyZ": "/tilesets/srtm/0/0/0.terrain?key=AbC&sig=XyZ",
+		"tiles/Tilesets/World/0/0/0.terrain?Key=A?B":   "tiles/tilesets/world/0/0/0.terrain?Key=A?B",
+		"/tilesets/srtm/0/0/0.terrain?":                "/tilesets/srtm/0/0/0.terrain?",
+	}
+	for key, normalized := range tests {
+		if got := normalizeKey(key); got != normalized {
+			t.Errorf("normalizeKey(%q): got %q, want %q", key, got, normalized)
+		}
+	}
+}
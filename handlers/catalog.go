@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// The catalog page. Tileset names come from the store so they are escaped by
+// html/template like any other untrusted input.
+var catalogTemplate = template.Must(template.New("catalog").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Terrain tilesets</title>
+</head>
+<body>
+<h1>Terrain tilesets</h1>
+{{if .Tilesets}}<table>
+<tr><th>Tileset</th><th>Metadata</th><th>Root tiles</th></tr>
+{{range .Tilesets}}<tr>
+<td>{{.Name}}</td>
+<td><a href="{{.Base}}/layer.json">layer.json</a></td>
+<td><a href="{{.Base}}/0/0/0.terrain">0/0/0</a> <a href="{{.Base}}/0/1/0.terrain">0/1/0</a></td>
+</tr>
+{{end}}</table>
+{{else}}<p>No tilesets were found.</p>
+{{end}}</body>
+</html>
+`))
+
+type catalogEntry struct {
+	Name string `json:"name"`
+	Base string `json:"url"` // the url of the tileset
+}
+
+// Return the tilesets in the store which can be listed publicly, those
+// restricted to clients with keys being omitted.
+func catalogEntries(tl stores.TilesetLister, baseUrl string, config Tilesets) ([]catalogEntry, error) {
+	tilesets, err := tl.Tilesets()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []catalogEntry{}
+	for _, name := range tilesets {
+		if config.Restricted(name) {
+			continue
+		}
+		entries = append(entries, catalogEntry{
+			Name: name,
+			Base: strings.TrimRight(baseUrl, "/") + "/" + name,
+		})
+	}
+	return entries, nil
+}
+
+// An HTTP handler which returns an HTML page listing the tilesets in the store
+// with links to their resources, for the benefit of human operators. The
+// tilesets are served under baseUrl e.g. `/tilesets`. Tilesets restricted to
+// clients with keys are not listed.
+func CatalogHandler(store stores.Storer, baseUrl string, config Tilesets) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tl, ok := store.(stores.TilesetLister)
+		if !ok {
+			http.Error(w, "The tilesets cannot be listed", http.StatusNotImplemented)
+			return
+		}
+
+		var (
+			data struct{ Tilesets []catalogEntry }
+			err  error
+		)
+		if data.Tilesets, err = catalogEntries(tl, baseUrl, config); err != nil {
+			log.Err(err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		var body bytes.Buffer
+		if err = catalogTemplate.Execute(&body, data); err != nil {
+			log.Err(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writeBody(w, r, http.StatusOK, body.Bytes())
+	}
+}
+
+// An HTTP handler which returns a JSON index of the tilesets in the store e.g.
+// `{"tilesets": [{"name": "srtm", "url": "/tilesets/srtm"}]}`, served at the
+// base url linked to from the root url. As with CatalogHandler tilesets
+// restricted to clients with keys are not listed.
+func TilesetsHandler(tl stores.TilesetLister, baseUrl string, config Tilesets) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := catalogEntries(tl, baseUrl, config)
+		if err != nil {
+			log.Err(err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		body, err := json.MarshalIndent(struct {
+			Tilesets []catalogEntry `json:"tilesets"`
+		}{entries}, "", "  ")
+		if err != nil {
+			log.Err(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeBody(w, r, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type connRequestsKey struct{}
+
+// CountConnectionRequests is used as a http.Server ConnContext function to
+// count the requests received on each connection, for use by
+// LimitConnectionRequests.
+func CountConnectionRequests(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connRequestsKey{}, new(int64))
+}
+
+// LimitConnectionRequests is HTTP middleware which closes a connection once it
+// has served max requests, so that a single client can't hold on to a
+// connection indefinitely. HTTP/1.1 connections are closed after the response
+// and HTTP/2 connections are sent a GOAWAY, letting outstanding streams
+// finish. The server must count requests with CountConnectionRequests.
+func LimitConnectionRequests(max int64, next http.Handler) http.Handler {
+	if max <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count, ok := r.Context().Value(connRequestsKey{}).(*int64); ok && atomic.AddInt64(count, 1) >= max {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"gopkg.in/rumicuna/mux.v2"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+)
+
+type coordKey struct{}
+
+// TileCoord returns the coordinate of the tile being requested. This is taken
+// from the `x`, `y` and `z` route variables unless the handler has been wrapped
+// by QuadkeyTiles.
+func TileCoord(r *http.Request) (x, y, z string) {
+	if coord, ok := r.Context().Value(coordKey{}).([3]string); ok {
+		return coord[0], coord[1], coord[2]
+	}
+
+	vars := mux.Vars(r)
+	return vars["x"], vars["y"], vars["z"]
+}
+
+// ValidateCoordPattern checks that a regular expression matching tile
+// coordinates in urls only matches decimal numbers, which are the only
+// coordinates tiles can be parsed from. Capturing groups aren't allowed as the
+// pattern is embedded in routes.
+func ValidateCoordPattern(pattern string) error {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("bad coordinate pattern %s: %s", pattern, err)
+	}
+	if err = decimalOnly(re); err != nil {
+		return fmt.Errorf("bad coordinate pattern %s: %s", pattern, err)
+	}
+	if regexp.MustCompile(`^(?:` + pattern + `)$`).MatchString("") {
+		return fmt.Errorf("bad coordinate pattern %s: it matches an empty coordinate", pattern)
+	}
+	return nil
+}
+
+// Return an error if a parsed regular expression can match anything other than
+// the digits 0-9.
+func decimalOnly(re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r < '0' || r > '9' {
+				return fmt.Errorf("%q is not a digit", r)
+			}
+		}
+	case syntax.OpCharClass:
+		for i := 0; i < len(re.Rune); i += 2 {
+			if re.Rune[i] < '0' || re.Rune[i+1] > '9' {
+				return fmt.Errorf("%s matches more than digits", re)
+			}
+		}
+	case syntax.OpEmptyMatch:
+	case syntax.OpCapture:
+		return fmt.Errorf("use a non-capturing group (?:...) instead of %s", re)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat, syntax.OpConcat, syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if err := decimalOnly(sub); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s matches more than digits", re)
+	}
+	return nil
+}
+
+// ParseQuadkey converts a quadkey at a zoom level into a tile coordinate in the
+// TMS scheme used by tilesets. Quadkeys number tiles from the north west as in
+// Bing Maps, with one digit per zoom level.
+func ParseQuadkey(quadkey string, z uint64) (x, y uint64, err error) {
+	if z > stores.MAX_ZOOM {
+		err = fmt.Errorf("the zoom level %d exceeds %d", z, stores.MAX_ZOOM)
+		return
+	}
+	if uint64(len(quadkey)) != z {
+		err = fmt.Errorf("the quadkey %s is not at zoom level %d", quadkey, z)
+		return
+	}
+
+	for _, digit := range quadkey {
+		if digit < '0' || digit > '3' {
+			err = fmt.Errorf("bad quadkey %s", quadkey)
+			return
+		}
+
+		d := uint64(digit - '0')
+		x = x<<1 | d&1
+		y = y<<1 | d>>1
+	}
+
+	y = (uint64(1) << z) - 1 - y // TMS rows count from the south
+	return
+}
+
+// QuadkeyTiles wraps a handler so that it serves tiles requested using the
+// `z` and `quadkey` route variables.
+func QuadkeyTiles(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		z, err := strconv.ParseUint(vars["z"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		x, y, err := ParseQuadkey(vars["quadkey"], z)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		coord := [3]string{strconv.FormatUint(x, 10), strconv.FormatUint(y, 10), vars["z"]}
+		handler(w, r.WithContext(context.WithValue(r.Context(), coordKey{}, coord)))
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCoordPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"[0-9]+", true},
+		{`\d+`, true},
+		{"[0-9]{1,2}", true},
+		{"0|[1-9][0-9]*", true},
+		{"(?:0|[1-9][0-9]*)", true},
+		{"[0-9]*", false}, // matches an empty coordinate
+		{"[0-9a-f]+", false},
+		{"-?[0-9]+", false},
+		{`\w+`, false},
+		{".+", false},
+		{"([0-9]+)", false},
+		{"^[0-9]+$", false},
+		{"[0-9", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateCoordPattern(test.pattern); (err == nil) != test.ok {
+			t.Errorf("ValidateCoordPattern(%q): got error %v", test.pattern, err)
+		}
+	}
+}
+
+func TestParseQuadkey(t *testing.T) {
+	tests := []struct {
+		quadkey string
+		z, x, y uint64
+		ok      bool
+	}{
+		{"", 0, 0, 0, true},
+		{"021", 3, 1, 5, true},
+		{strings.Repeat("3", 30), 30, 1<<30 - 1, 0, true},
+		{strings.Repeat("0", 64), 64, 0, 0, false},
+		{"02", 3, 0, 0, false},
+		{"024", 3, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		x, y, err := ParseQuadkey(test.quadkey, test.z)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseQuadkey(%q, %d): got error %v", test.quadkey, test.z, err)
+		} else if test.ok && (x != test.x || y != test.y) {
+			t.Errorf("ParseQuadkey(%q, %d): got %d/%d, want %d/%d", test.quadkey, test.z, x, y, test.x, test.y)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"sync"
+	"time"
+)
+
+// CoverageCache holds the coverage masks of tilesets in memory, loading them
+// from a store on first use and reloading them after TILESET_CACHE_TTL. The
+// masks of tilesets which aren't in the store are not cached.
+type CoverageCache struct {
+	store stores.CoverageStorer
+	lock  sync.RWMutex
+	masks map[string]coverage
+}
+
+// The coverage mask of a tileset.
+type coverage struct {
+	mask    *stores.Coverage // nil means everything is covered
+	expires time.Time
+}
+
+// NewCoverageCache returns a CoverageCache for the store. If the store does
+// not provide coverage masks then all tiles are considered covered.
+func NewCoverageCache(store stores.Storer) *CoverageCache {
+	cs, _ := store.(stores.CoverageStorer)
+	return &CoverageCache{
+		store: cs,
+		masks: make(map[string]coverage),
+	}
+}
+
+func (this *CoverageCache) mask(tileset string) *stores.Coverage {
+	now := time.Now()
+	this.lock.RLock()
+	entry, ok := this.masks[tileset]
+	this.lock.RUnlock()
+	if ok && now.Before(entry.expires) {
+		return entry.mask
+	}
+
+	// Tileset names come from clients so only existing tilesets are held.
+	if this.store.TilesetStatus(tileset) == stores.NOT_FOUND {
+		return nil
+	}
+
+	mask, err := this.store.Coverage(tileset)
+	if err != nil {
+		mask = nil
+		if err != stores.ErrNoItem {
+			log.Err(fmt.Sprintf("cannot load coverage for %s: %s", tileset, err))
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.masks[tileset]; !ok && len(this.masks) >= MAX_CACHED_TILESETS {
+		for name, entry := range this.masks {
+			if !now.Before(entry.expires) {
+				delete(this.masks, name)
+			}
+		}
+		if len(this.masks) >= MAX_CACHED_TILESETS {
+			return mask // full: the mask is loaded again next time
+		}
+	}
+	this.masks[tileset] = coverage{mask, now.Add(TILESET_CACHE_TTL)}
+	return mask
+}
+
+// Covers returns false if the tile is known to lie outside the tileset's
+// coverage.
+func (this *CoverageCache) Covers(tileset string, tile *stores.Terrain) bool {
+	if this.store == nil {
+		return true
+	}
+
+	if mask := this.mask(tileset); mask != nil {
+		return mask.Covers(tile)
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"net/http"
+	"regexp"
+)
+
+// Store configuration which is redacted from descriptions: values of settings
+// named as secrets, and the passwords in urls e.g. connection strings.
+var (
+	secretSetting = regexp.MustCompile(`(?i)password|secret|token|credential`)
+	urlPassword   = regexp.MustCompile(`(://[^:/@\s]*):[^@\s]*@`)
+)
+
+const REDACTED = "xxxxx"
+
+// Remove secrets from a store description.
+func redact(desc stores.Description) stores.Description {
+	config := make(map[string]string, len(desc.Config))
+	for name, value := range desc.Config {
+		if secretSetting.MatchString(name) {
+			value = REDACTED
+		} else {
+			value = urlPassword.ReplaceAllString(value, "$1:"+REDACTED+"@")
+		}
+		config[name] = value
+	}
+	if desc.Config != nil {
+		desc.Config = config
+	}
+	desc.Error = urlPassword.ReplaceAllString(desc.Error, "$1:"+REDACTED+"@")
+	return desc
+}
+
+// Return HTTP middleware which only passes on requests presenting the token
+// in an `Authorization: Bearer` header.
+func RequireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// An HTTP handler which returns a JSON description of the configured stores,
+// in the order in which they are used. Secrets such as passwords are
+// redacted.
+func StoresHandler(describers ...stores.Describer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		descriptions := make([]stores.Description, len(describers))
+		for i, describer := range describers {
+			descriptions[i] = redact(describer.Describe())
+		}
+
+		body, err := json.MarshalIndent(descriptions, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		headers := w.Header()
+		headers.Set("Content-Type", "application/json")
+		headers.Set("Cache-Control", "no-store")
+		w.Write(body)
+	}
+}
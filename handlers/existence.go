@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"sync"
+	"time"
+)
+
+// The availability and coverage of tilesets are reloaded after this time, so
+// that changes to tilesets are picked up without a restart.
+const TILESET_CACHE_TTL = 10 * time.Minute
+
+// The maximum number of tilesets whose availability or coverage is held.
+// Only tilesets in the store are held, but the store may hold many.
+const MAX_CACHED_TILESETS = 10000
+
+// ExistenceCache holds the tiles available in tilesets in memory so that
+// requests for missing tiles can be answered without a store lookup. The
+// available tiles are loaded on first use from the `available` property of the
+// tileset's `layer.json` or, failing that, by scanning the store, and are
+// reloaded after TILESET_CACHE_TTL. The total number of tile ranges held is
+// capped: tilesets which would exceed the cap are not cached and all their
+// tiles are assumed to exist. Tilesets which aren't in the store are not
+// cached.
+type ExistenceCache struct {
+	store     stores.Storer
+	maxRanges int
+	lock      sync.RWMutex
+	ranges    int // the number of tile ranges held
+	available map[string]*availability
+}
+
+// The tiles available in a tileset.
+type availability struct {
+	ranges  [][]stores.TileRange // nil means availability is unknown
+	count   int                  // the number of ranges
+	expires time.Time
+}
+
+// NewExistenceCache returns an ExistenceCache for the store holding no more
+// than maxRanges tile ranges.
+func NewExistenceCache(store stores.Storer, maxRanges int) *ExistenceCache {
+	return &ExistenceCache{
+		store:     store,
+		maxRanges: maxRanges,
+		available: make(map[string]*availability),
+	}
+}
+
+// Return the tiles available in a tileset, or nil if they can't be determined.
+func (this *ExistenceCache) load(tileset string) (available [][]stores.TileRange, err error) {
+	if body, err := this.store.Layer(tileset); err == nil {
+		var layer stores.Layer
+		if err = json.Unmarshal(body, &layer); err != nil {
+			return nil, err
+		}
+
+		if len(layer.Available) > 0 {
+			return layer.Available, nil
+		}
+	} else if err != stores.ErrNoItem {
+		return nil, err
+	}
+
+	if as, ok := this.store.(stores.AvailabilityStorer); ok {
+		if available, err = as.Available(tileset); err == stores.ErrNoItem {
+			err = nil
+		}
+	}
+	return
+}
+
+func (this *ExistenceCache) tileset(tileset string) [][]stores.TileRange {
+	now := time.Now()
+	this.lock.RLock()
+	entry, ok := this.available[tileset]
+	this.lock.RUnlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ranges
+	}
+
+	// Don't scan for, or remember, tilesets which don't exist: the names
+	// come from clients.
+	if this.store.TilesetStatus(tileset) == stores.NOT_FOUND {
+		return nil
+	}
+
+	available, err := this.load(tileset)
+	if err != nil {
+		log.Err(fmt.Sprintf("cannot load the tiles available in %s: %s", tileset, err))
+		available = nil
+	}
+
+	count := 0
+	for _, ranges := range available {
+		count += len(ranges)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if entry, ok := this.available[tileset]; ok {
+		if now.Before(entry.expires) {
+			return entry.ranges // loaded concurrently
+		}
+		this.remove(tileset)
+	}
+	if len(this.available) >= MAX_CACHED_TILESETS {
+		this.expire(now)
+	}
+
+	if this.ranges+count > this.maxRanges || len(this.available) >= MAX_CACHED_TILESETS {
+		log.Notice(fmt.Sprintf("existence cache full: not caching the %d tile ranges of %s", count, tileset))
+		available, count = nil, 0
+	}
+	this.available[tileset] = &availability{available, count, now.Add(TILESET_CACHE_TTL)}
+	this.ranges += count
+	return available
+}
+
+// Remove a tileset from the cache. The lock must be held.
+func (this *ExistenceCache) remove(tileset string) {
+	this.ranges -= this.available[tileset].count
+	delete(this.available, tileset)
+}
+
+// Remove the tilesets which have expired. The lock must be held.
+func (this *ExistenceCache) expire(now time.Time) {
+	for tileset, entry := range this.available {
+		if !now.Before(entry.expires) {
+			this.remove(tileset)
+		}
+	}
+}
+
+// Exists returns false if the tile is known to be missing from the tileset.
+func (this *ExistenceCache) Exists(tileset string, tile *stores.Terrain) bool {
+	available := this.tileset(tileset)
+	if available == nil {
+		return true
+	}
+
+	if tile.Z >= uint64(len(available)) {
+		return false
+	}
+
+	for _, r := range available[tile.Z] {
+		if tile.X >= r.StartX && tile.X <= r.EndX && tile.Y >= r.StartY && tile.Y <= r.EndY {
+			return true
+		}
+	}
+	return false
+}
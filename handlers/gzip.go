@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// The default limit on the size of a decompressed tile. A heightmap tile is
+// well under 100kB when inflated so this leaves plenty of headroom for other
+// formats whilst still being bounded.
+const DefaultMaxDecompressed Bytes = 5 * 1024 * 1024
+
+var ErrDecompressedTooLarge = errors.New("decompressed size exceeds limit")
+
+// Gunzip inflates gzip encoded data. No more than limit bytes are read from the
+// decompressor: if the data inflates beyond this ErrDecompressedTooLarge is
+// returned. This guards against maliciously crafted tiles (zip bombs)
+// exhausting memory.
+func Gunzip(data []byte, limit Bytes) (body []byte, err error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	// Read one byte beyond the limit so that overflow can be detected.
+	body, err = ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		body = nil
+		return
+	}
+
+	if Bytes(len(body)) > limit {
+		body = nil
+		err = ErrDecompressedTooLarge
+	}
+	return
+}
+
+// VerifyGzip checks that data is a complete gzip stream. The whole stream is
+// inflated so that the CRC-32 and size recorded in the trailer are validated,
+// detecting corruption and truncation.
+func VerifyGzip(data []byte) error {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+// The number of bytes needed by sniffEncoding to detect an encoding.
+const SNIFF_LENGTH = 4
+
+// MultistreamGzip returns true if data is a concatenation of more than one gzip
+// member (stream). Some clients only read the first member of such tiles.
+func MultistreamGzip(data []byte) (bool, error) {
+	input := bytes.NewReader(data)
+	reader, err := gzip.NewReader(input)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	// Read the first member, leaving the input positioned after it: the
+	// input is read byte by byte so no more than the member is consumed.
+	reader.Multistream(false)
+	if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+		return false, err
+	}
+	return input.Len() > 0, nil
+}
+
+// NormalizeGzip recompresses multistream gzip data as a single stream, the
+// decompressed data being limited in size as with Gunzip.
+func NormalizeGzip(data []byte, limit Bytes) ([]byte, error) {
+	body, err := Gunzip(data, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err = writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The content coding of tiles compressed with a shared dictionary (see
+// TerrainOptions.GzipDictionary): a zlib stream (RFC 1950) whose header records
+// the Adler-32 checksum of the preset dictionary it was compressed with.
+const DICTIONARY_ENCODING = "x-deflate-dict"
+
+// DeflateDict compresses data as a zlib stream using a preset dictionary of
+// data common to tiles, which shrinks small tiles in particular. Decoding the
+// stream requires the same dictionary (e.g. with zlib.NewReaderDict), which
+// standard HTTP clients such as browsers don't have: it is only suitable for
+// clients which have been given the dictionary out of band and advertise
+// DICTIONARY_ENCODING in their Accept-Encoding header. Only the last 32kB of
+// the dictionary, the size of the deflate window, can be referenced.
+func DeflateDict(data, dict []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := zlib.NewWriterLevelDict(&buf, zlib.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Return the content encoding of data by looking for the gzip or zstd magic
+// numbers.
+func sniffEncoding(data []byte) string {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return "gzip"
+	}
+	if len(data) >= 4 && data[0] == 0x28 && data[1] == 0xb5 && data[2] == 0x2f && data[3] == 0xfd {
+		return "zstd"
+	}
+	return "identity"
+}
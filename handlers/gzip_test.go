@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGunzip(t *testing.T) {
+	small := bytes.Repeat([]byte("terrain"), 1000)
+	// A bomb: ten megabytes of zeros compress to around ten kilobytes.
+	bomb := make([]byte, 10*1024*1024)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit Bytes
+		body  []byte
+		err   error
+	}{
+		{"within limit", gzipData(t, small), 1024 * 1024, small, nil},
+		{"at limit", gzipData(t, small), Bytes(len(small)), small, nil},
+		{"over limit", gzipData(t, small), Bytes(len(small)) - 1, nil, ErrDecompressedTooLarge},
+		{"bomb", gzipData(t, bomb), DefaultMaxDecompressed, nil, ErrDecompressedTooLarge},
+	}
+
+	for _, test := range tests {
+		body, err := Gunzip(test.data, test.limit)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: got %d bytes, want %d", test.name, len(body), len(test.body))
+		}
+	}
+
+	if _, err := Gunzip([]byte("not gzip"), DefaultMaxDecompressed); err == nil {
+		t.Error("invalid data: got no error")
+	}
+}
@@ -1,6 +1,18 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"github.com/geo-data/cesium-terrain-server/trace"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Bytes uint64
 
@@ -11,7 +23,10 @@ type ResponseLimiter interface {
 
 type LimiterFactory func(writer http.ResponseWriter, limit Bytes) ResponseLimiter
 
-// Return HTTP middleware which allows CORS requests from any domain
+// Return HTTP middleware which allows CORS requests from any domain. The
+// headers are set before the next handler is called so they are present on all
+// responses, including errors sent with http.Error: otherwise browsers report a
+// CORS failure instead of the real status.
 func AddCorsHeader(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		headers := w.Header()
@@ -19,3 +34,207 @@ func AddCorsHeader(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Return HTTP middleware which answers CORS preflight requests, sent by
+// browsers before requests with headers other than the simple headers (e.g. a
+// deadline header). Browsers may cache the result for maxAge: zero leaves this
+// to the browser.
+func CorsPreflight(maxAge time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" || r.Header.Get("Origin") == "" || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headers := w.Header()
+		headers.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			headers.Set("Access-Control-Allow-Headers", requested)
+		}
+		if maxAge > 0 {
+			headers.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+		}
+		headers.Add("Vary", "Access-Control-Request-Headers")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Return a name describing a store for use in diagnostics.
+func storeName(store stores.Storer) string {
+	if s, ok := store.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", store)
+}
+
+// Load a tile from a store, recording a span if the request is being traced.
+func loadTile(ctx context.Context, store stores.Storer, tileset string, t *stores.Terrain) (err error) {
+	span := trace.Start(ctx, "store.Tile")
+	span.SetAttribute("tileset", tileset)
+	span.SetAttribute("z", strconv.FormatUint(t.Z, 10))
+	span.SetAttribute("x", strconv.FormatUint(t.X, 10))
+	span.SetAttribute("y", strconv.FormatUint(t.Y, 10))
+	span.SetAttribute("store", storeName(store))
+	defer func() {
+		if err == stores.ErrNoItem {
+			span.SetAttribute("missing", "true")
+			span.Finish(nil)
+		} else {
+			span.Finish(err)
+		}
+	}()
+
+	return store.Tile(tileset, t)
+}
+
+// ErrTimeout is returned when a store takes too long to load a tile.
+var ErrTimeout = errors.New("timed out waiting for the tile store")
+
+// A panic in a lookup run in the background, carrying the stack of the
+// goroutine in which it occurred.
+type lookupPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (this *lookupPanic) Error() string {
+	return fmt.Sprintf("%v\n%s", this.value, this.stack)
+}
+
+// Run a store lookup, giving up when the context's deadline passes. The store
+// can't be interrupted, so an abandoned lookup continues in the background:
+// release is called once it completes, abandoned or not, so that lookups still
+// running count against limits such as the Scheduler's, and discard (if set)
+// is called if an abandoned lookup succeeds, to free what it loaded. A panic in
+// the lookup is raised again in the calling goroutine so that it can be
+// recovered (see Recover), or logged if the lookup has been abandoned.
+func lookupDeadline(ctx context.Context, lookup func(context.Context) error, discard, release func()) error {
+	done := make(chan error, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- &lookupPanic{rec, debug.Stack()}
+			}
+		}()
+		done <- lookup(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if p, ok := err.(*lookupPanic); ok {
+			panic(p)
+		}
+		return err
+	case <-ctx.Done():
+		go func() {
+			err := <-done
+			if p, ok := err.(*lookupPanic); ok {
+				log.Crit(fmt.Sprintf("panic in abandoned store lookup: %s", p))
+			} else if err == nil && discard != nil {
+				discard()
+			}
+		}()
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// HTTP/1.0 caches don't understand Cache-Control, so express its max-age and
+// no-cache directives with the equivalent Expires and Pragma headers.
+func http10CacheHeaders(headers http.Header) {
+	for _, directive := range strings.Split(headers.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			headers.Set("Pragma", "no-cache")
+			headers.Set("Expires", "0")
+		} else if strings.HasPrefix(directive, "max-age=") && headers.Get("Expires") == "" {
+			if age, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				headers.Set("Expires", time.Now().Add(time.Duration(age)*time.Second).UTC().Format(http.TimeFormat))
+			}
+		}
+	}
+}
+
+// Return true if an HTTP/1.0 request asks for the connection to be kept alive.
+// HTTP/1.0 connections are otherwise closed after each response.
+func http10KeepAlive(r *http.Request) bool {
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "keep-alive") {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a fully materialised response body with an explicit Content-Length, so
+// that responses are never chunked and HEAD requests, which have no body,
+// report the same headers as GET requests.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// Return true if a Range header requests the whole of a body of size bytes,
+// e.g. `bytes=0-` as sent by clients regardless of whether they want a part of
+// the body. Such requests are best answered in full with a 200.
+func wholeRange(header string, size int64) bool {
+	spec := strings.TrimSpace(header)
+	if !strings.HasPrefix(spec, "bytes=0-") || strings.Contains(spec, ",") {
+		return false
+	}
+
+	end := strings.TrimSpace(strings.TrimPrefix(spec, "bytes=0-"))
+	if end == "" {
+		return true
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	return err == nil && last >= size-1
+}
+
+// Return HTTP middleware which rejects requests with URLs longer than max
+// bytes. Tile URLs are short so a tight limit protects the server from abusive
+// requests without affecting legitimate clients.
+func LimitURLLength(max int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > max {
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Return the HTTP status code appropriate for an error returned by a store.
+func errorStatus(err error) int {
+	if err == stores.ErrUnavailable {
+		return http.StatusServiceUnavailable
+	} else if err == ErrTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// Return HTTP middleware which recovers from panics in the next handler,
+// logging the stack trace along with the request and responding with a 500
+// instead of dropping the connection.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec) // a deliberate abort of the response
+				}
+
+				log.Crit(fmt.Sprintf("panic serving %s %s: %v\n%s", r.Method, r.URL.String(), rec, debug.Stack()))
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
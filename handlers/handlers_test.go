@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"github.com/geo-data/cesium-terrain-server/stores/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddCorsHeader(t *testing.T) {
+	root, _ := tileDir(t)
+	defer os.RemoveAll(root)
+
+	router := tileRouter(TerrainHandler(fs.New(root), TerrainOptions{MaxDecompressed: DefaultMaxDecompressed}))
+	router.Handle("/debug/stores", RequireToken("secret", http.NotFoundHandler()))
+	handler := AddCorsHeader(LimitURLLength(100, router))
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/tilesets/test/0/0/0.terrain", http.StatusOK},
+		{"/tilesets/test/0/0/1.terrain", http.StatusNotFound},
+		{"/tilesets/missing/0/0/0.terrain", http.StatusNotFound},
+		{"/tilesets/test/0/0/0.terrain?" + strings.Repeat("a", 100), http.StatusRequestURITooLong},
+		{"/debug/stores", http.StatusUnauthorized},
+		{"/unrouted", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.url, rec.Code, test.status)
+		}
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want *", test.url, origin)
+		}
+	}
+}
+
+// A store which panics when reading tiles, as a buggy store might.
+type panicStore struct {
+	tiles map[string][]byte
+}
+
+func (this *panicStore) Tile(tileset string, tile *stores.Terrain) error {
+	this.tiles[tileset] = nil // panics as the map is nil
+	return nil
+}
+
+func (this *panicStore) Layer(tileset string) ([]byte, error) {
+	panic("layer")
+}
+
+func (this *panicStore) TilesetStatus(tileset string) stores.TilesetStatus {
+	return stores.FOUND
+}
+
+func TestRecover(t *testing.T) {
+	// With a timeout the store is read in another goroutine. A single
+	// scheduler slot is only available to later requests if a panicking
+	// lookup releases it.
+	options := []TerrainOptions{
+		{MaxDecompressed: DefaultMaxDecompressed},
+		{MaxDecompressed: DefaultMaxDecompressed, StoreTimeout: time.Minute},
+		{MaxDecompressed: DefaultMaxDecompressed, Scheduler: NewScheduler(1)},
+		{MaxDecompressed: DefaultMaxDecompressed, Scheduler: NewScheduler(1), StoreTimeout: time.Minute},
+	}
+
+	for i, option := range options {
+		router := tileRouter(TerrainHandler(&panicStore{}, option))
+		router.HandleFunc("/tilesets/{tileset}/layer.json", LayerHandler(&panicStore{}, LayerOptions{}))
+		handler := Recover(router)
+
+		tests := []string{
+			"/tilesets/test/0/0/0.terrain",
+			"/tilesets/test/0/0/1.terrain",
+			"/tilesets/test/layer.json",
+		}
+		for _, url := range tests {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("options %d, %s: got status %d, want %d", i, url, rec.Code, http.StatusInternalServerError)
+			}
+			if body := strings.TrimSpace(rec.Body.String()); body != http.StatusText(http.StatusInternalServerError) {
+				t.Errorf("options %d, %s: got body %q", i, url, body)
+			}
+		}
+	}
+
+	// Deliberate aborts are left to the server.
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("abort: got panic %v, want %v", rec, http.ErrAbortHandler)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"gopkg.in/rumicuna/mux.v2"
+	"net/http"
+)
+
+// The content of a hashed tile url never changes so it can be cached forever.
+const HASHED_CACHE_CONTROL = "max-age=31536000, immutable"
+
+// An HTTP handler which returns a terrain tile by the hex MD5 digest of its
+// content, taken from the `hash` route variable. As the url identifies the
+// content the response can be cached indefinitely. The tile is checked against
+// its hash so that a misplaced file is never cached in its place.
+func HashedTileHandler(store stores.Storer, options TerrainOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			t   stores.Terrain
+			err error
+		)
+
+		defer func() {
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				log.Err(err.Error())
+			}
+		}()
+
+		tileset := TilesetName(r)
+		hash := mux.Vars(r)["hash"]
+		hs, ok := store.(stores.HashStorer)
+		if !ok {
+			http.Error(w, errors.New("The terrain tile does not exist").Error(), http.StatusNotFound)
+			return
+		}
+
+		if err = hs.HashTile(tileset, hash, &t); err == stores.ErrNoItem {
+			err = nil
+			http.Error(w, errors.New("The terrain tile does not exist").Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			return
+		}
+		recordSource(r, tileSource(store, &t))
+
+		if actual := hex.EncodeToString(t.MD5()); actual != hash {
+			log.Err(fmt.Sprintf("hashed tile %s/%s has the hash %s", tileset, hash, actual))
+			http.Error(w, errors.New("The terrain tile is corrupt").Error(), http.StatusBadGateway)
+			return
+		}
+
+		body, err := t.MarshalBinary()
+		if err != nil {
+			return
+		}
+
+		encoding := options.Tilesets.Get(tileset).Encoding
+		if encoding == "" {
+			encoding = sniffEncoding(body)
+		}
+		if encoding == "zstd" && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "zstd") {
+			if body, encoding, err = transcodeZstd(r, body, &options); err != nil {
+				return
+			}
+		}
+		if encoding == "gzip" && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			if body, err = options.gunzip(body, &t, false); err != nil {
+				return
+			}
+			encoding = "identity"
+		}
+
+		headers := w.Header()
+		headers.Set("Content-Type", options.Tilesets.Get(tileset).MediaType())
+		headers.Add("Vary", "Accept-Encoding")
+		if encoding != "identity" {
+			headers.Set("Content-Encoding", encoding)
+		}
+		if options.Tilesets.Restricted(tileset) {
+			headers.Set("Cache-Control", "private, "+HASHED_CACHE_CONTROL) // see RestrictTilesets
+		} else {
+			headers.Set("Cache-Control", "public, "+HASHED_CACHE_CONTROL)
+		}
+		headers.Set("ETag", `"`+hash+`"`)
+		writeBody(w, r, http.StatusOK, body)
+	}
+}
+
+// An HTTP handler which returns the manifest listing the hash of each tile in
+// a tileset, from which clients find the hashed url of a tile.
+func HashManifestHandler(store stores.Storer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tileset := TilesetName(r)
+		hs, ok := store.(stores.HashStorer)
+		if !ok {
+			http.Error(w, fmt.Sprintf("The tileset `%s` has no hashed tiles", tileset), http.StatusNotFound)
+			return
+		}
+
+		body, err := hs.HashManifest(tileset)
+		if err == stores.ErrNoItem {
+			http.Error(w, fmt.Sprintf("The tileset `%s` has no hashed tiles", tileset), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Err(err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeBody(w, r, http.StatusOK, body)
+	}
+}
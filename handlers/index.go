@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"net/http"
+	"strings"
+)
+
+// An HTTP handler for the base url of a tileset. If redirect is true clients
+// are redirected to the tileset's `layer.json`, otherwise a JSON index linking
+// to the tileset's resources is returned.
+func TilesetIndexHandler(store stores.Storer, redirect bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tileset := TilesetName(r)
+		if store.TilesetStatus(tileset) == stores.NOT_FOUND {
+			http.Error(w,
+				fmt.Errorf("The tileset `%s` does not exist", tileset).Error(),
+				http.StatusNotFound)
+			return
+		}
+
+		base := strings.TrimRight(r.URL.Path, "/") + "/"
+		if redirect {
+			http.Redirect(w, r, base+"layer.json", http.StatusMovedPermanently)
+			return
+		}
+
+		body, err := json.MarshalIndent(map[string]string{
+			"tileset": tileset,
+			"layer":   base + "layer.json",
+			"tiles":   base + "{z}/{x}/{y}.terrain",
+		}, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
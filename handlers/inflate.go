@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"container/list"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"sync"
+	"sync/atomic"
+)
+
+// InflateCache is a bounded cache of decompressed tiles, saving the cost of
+// decompressing frequently requested gzipped tiles for each client which
+// doesn't accept gzip. Tiles are keyed by the digest of their compressed
+// content, so that a changed tile is never served from the cache and identical
+// tiles share an entry. The least recently used tiles are evicted when the
+// cache is full. It is safe for concurrent use.
+type InflateCache struct {
+	hits, misses uint64 // updated atomically
+
+	maxSize Bytes
+
+	lock  sync.Mutex
+	lru   *list.List               // entries, most recently used first
+	index map[string]*list.Element // entries by key
+	size  Bytes                    // the total size of the entries
+}
+
+type inflated struct {
+	key  string
+	body []byte
+}
+
+// NewInflateCache returns a cache holding at most maxSize bytes of
+// decompressed tiles.
+func NewInflateCache(maxSize Bytes) *InflateCache {
+	return &InflateCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+// Gunzip returns the decompressed data of a gzipped tile whose content has the
+// digest key, decompressing it as with Gunzip if it isn't cached. The returned
+// body is shared so must not be modified.
+func (this *InflateCache) Gunzip(key string, data []byte, limit Bytes) ([]byte, error) {
+	this.lock.Lock()
+	if elem, ok := this.index[key]; ok {
+		this.lru.MoveToFront(elem)
+		this.lock.Unlock()
+		atomic.AddUint64(&this.hits, 1)
+		return elem.Value.(*inflated).body, nil
+	}
+	this.lock.Unlock()
+	atomic.AddUint64(&this.misses, 1)
+
+	body, err := Gunzip(data, limit)
+	if err != nil || Bytes(len(body)) > this.maxSize {
+		return body, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.index[key]; ok {
+		return body, nil // added concurrently
+	}
+	this.index[key] = this.lru.PushFront(&inflated{key, body})
+	this.size += Bytes(len(body))
+	for this.size > this.maxSize {
+		oldest := this.lru.Back()
+		entry := oldest.Value.(*inflated)
+		this.lru.Remove(oldest)
+		delete(this.index, entry.key)
+		this.size -= Bytes(len(entry.body))
+	}
+	return body, nil
+}
+
+func (this *InflateCache) String() string {
+	return "inflate"
+}
+
+// CacheStats implements the stores.CacheStatter interface.
+func (this *InflateCache) CacheStats() stores.CacheStats {
+	this.lock.Lock()
+	size, entries := this.size, this.lru.Len()
+	this.lock.Unlock()
+
+	return stores.CacheStats{
+		Size:    int64(size),
+		MaxSize: int64(this.maxSize),
+		Entries: int64(entries),
+		Hits:    atomic.LoadUint64(&this.hits),
+		Misses:  atomic.LoadUint64(&this.misses),
+	}
+}
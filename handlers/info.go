@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"net/http"
+	"time"
+)
+
+// The JSON description of a tile returned by InfoHandler.
+type tileInfo struct {
+	Tileset  string `json:"tileset"`
+	Z        uint64 `json:"z"`
+	X        uint64 `json:"x"`
+	Y        uint64 `json:"y"`
+	Store    string `json:"store"`
+	Size     int64  `json:"size"`
+	Encoding string `json:"encoding,omitempty"`
+	Modified string `json:"modified,omitempty"`
+}
+
+// Describe a tile, loading it if the store can't describe it more cheaply.
+func statTile(store stores.Storer, tileset string, t *stores.Terrain) (*stores.TileInfo, error) {
+	if ss, ok := store.(stores.StatStorer); ok {
+		return ss.Stat(tileset, t)
+	}
+
+	if err := store.Tile(tileset, t); err != nil {
+		return nil, err
+	}
+
+	body, err := t.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &stores.TileInfo{
+		Store:    storeName(store),
+		Size:     int64(len(body)),
+		Encoding: sniffEncoding(body),
+	}, nil
+}
+
+// An HTTP handler which returns a JSON description of a terrain tile: the
+// store holding it, its size and encoding and when it was last modified. Where
+// the store supports it the tile is described without being read.
+func InfoHandler(store stores.Storer, tilesets Tilesets) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			t   stores.Terrain
+			err error
+		)
+
+		defer func() {
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				log.Err(err.Error())
+			}
+		}()
+
+		tileset := TilesetName(r)
+		if err = t.ParseCoord(TileCoord(r)); err != nil {
+			return
+		}
+
+		info, err := statTile(store, tileset, &t)
+		if err == stores.ErrNoItem {
+			err = nil
+			if store.TilesetStatus(tileset) == stores.NOT_FOUND {
+				http.Error(w,
+					fmt.Errorf("The tileset `%s` does not exist", tileset).Error(),
+					http.StatusNotFound)
+				return
+			}
+			http.Error(w, errors.New("The terrain tile does not exist").Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			return
+		}
+
+		if encoding := tilesets.Get(tileset).Encoding; encoding != "" {
+			info.Encoding = encoding
+		}
+
+		body := tileInfo{
+			Tileset:  tileset,
+			Z:        t.Z,
+			X:        t.X,
+			Y:        t.Y,
+			Store:    info.Store,
+			Size:     info.Size,
+			Encoding: info.Encoding,
+		}
+		if !info.Modified.IsZero() {
+			body.Modified = info.Modified.UTC().Format(time.RFC3339)
+		}
+
+		var data []byte
+		if data, err = json.MarshalIndent(body, "", "  "); err != nil {
+			return
+		}
+
+		headers := w.Header()
+		headers.Set("Content-Type", "application/json")
+		if !info.Modified.IsZero() {
+			headers.Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+		}
+		w.Write(data)
+	}
+}
@@ -1,15 +1,89 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/geo-data/cesium-terrain-server/log"
 	"github.com/geo-data/cesium-terrain-server/stores"
-	"gopkg.in/rumicuna/mux.v2"
 	"net/http"
 )
 
+// The default content type of `layer.json` responses.
+const LAYER_CONTENT_TYPE = "application/json"
+
+// LayerOptions customises the behaviour of LayerHandler.
+type LayerOptions struct {
+	// Include the zoom extent of the tileset in the default `layer.json`, if
+	// the store can determine it.
+	ZoomExtent bool
+
+	// Send the default `layer.json`, with no tiles available, for tilesets
+	// that don't exist instead of a 404.
+	DefaultMissing bool
+
+	// Check that `layer.json` files from the store are valid JSON, responding
+	// with a 500 instead of sending a broken file.
+	Validate bool
+
+	Tilesets Tilesets // per tileset configuration
+
+	// If set, the time each tileset was last requested is recorded.
+	Access *AccessTimes
+
+	// The attribution (e.g. a copyright notice) set in `layer.json` files
+	// unless the tileset configures its own. If neither is set files are
+	// sent as they are.
+	Attribution string
+
+	// The content type of responses, LAYER_CONTENT_TYPE if empty, e.g.
+	// `application/json; charset=utf-8` for clients which require the
+	// charset parameter.
+	ContentType string
+}
+
+// Return the default `layer.json` for a tileset.
+func defaultLayer(store stores.Storer, tileset string, options LayerOptions) ([]byte, error) {
+	layer := stores.DefaultLayer(options.Tilesets.Get(tileset).Format)
+
+	if zs, ok := store.(stores.ZoomStorer); ok && options.ZoomExtent {
+		min, max, err := zs.Zooms(tileset)
+		if err == nil {
+			layer.SetZoomExtent(min, max)
+		} else if err != stores.ErrNoItem {
+			return nil, err
+		}
+	}
+
+	return json.MarshalIndent(layer, "", "  ")
+}
+
+// Return the default `layer.json` for a tileset with no tiles. A single empty
+// zoom level is listed as available, which tells clients that not even the
+// root tiles exist.
+func emptyLayer(format string) ([]byte, error) {
+	layer := stores.DefaultLayer(format)
+	layer.Available = [][]stores.TileRange{{}}
+	return json.MarshalIndent(layer, "", "  ")
+}
+
+// Set the attribution field of a `layer.json` file, replacing any existing
+// attribution.
+func attributeLayer(layer []byte, attribution string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(layer, &fields); err != nil {
+		return nil, err
+	}
+
+	value, err := json.Marshal(attribution)
+	if err != nil {
+		return nil, err
+	}
+	fields["attribution"] = value
+	return json.MarshalIndent(fields, "", "  ")
+}
+
 // An HTTP handler which returns a tileset's `layer.json` file
-func LayerHandler(store stores.Storer) func(http.ResponseWriter, *http.Request) {
+func LayerHandler(store stores.Storer, options LayerOptions) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			err   error
@@ -18,38 +92,65 @@ func LayerHandler(store stores.Storer) func(http.ResponseWriter, *http.Request)
 
 		defer func() {
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), errorStatus(err))
 				log.Err(err.Error())
 			}
 		}()
 
-		vars := mux.Vars(r)
+		tileset := TilesetName(r)
+		if options.Access != nil {
+			options.Access.Record(tileset)
+		}
 
 		// Try and get a `layer.json` from the stores
-		layer, err = store.Layer(vars["tileset"])
+		layer, err = store.Layer(tileset)
 		if err == stores.ErrNoItem {
 			err = nil // don't persist this error
-			if store.TilesetStatus(vars["tileset"]) == stores.NOT_FOUND {
-				http.Error(w,
-					fmt.Errorf("The tileset `%s` does not exist", vars["tileset"]).Error(),
-					http.StatusNotFound)
+			if store.TilesetStatus(tileset) == stores.NOT_FOUND {
+				if !options.DefaultMissing {
+					http.Error(w,
+						fmt.Errorf("The tileset `%s` does not exist", tileset).Error(),
+						http.StatusNotFound)
+					return
+				}
+
+				if layer, err = emptyLayer(options.Tilesets.Get(tileset).Format); err != nil {
+					return
+				}
+			} else if layer, err = defaultLayer(store, tileset, options); err != nil {
+				// the directory exists: send the default `layer.json`
 				return
 			}
-
-			// the directory exists: send the default `layer.json`
-			layer = []byte(`{
-  "tilejson": "2.1.0",
-  "format": "heightmap-1.0",
-  "version": "1.0.0",
-  "scheme": "tms",
-  "tiles": ["{z}/{x}/{y}.terrain"]
-}`)
 		} else if err != nil {
 			return
+		} else if options.Validate {
+			var v interface{}
+			if jsonErr := json.Unmarshal(layer, &v); jsonErr != nil {
+				log.Err(fmt.Sprintf("invalid layer.json for tileset %s: %s", tileset, jsonErr))
+				http.Error(w, fmt.Sprintf("The layer.json for tileset `%s` is invalid", tileset), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if layer, err = versionLayer(r, layer); err != nil {
+			return
 		}
 
-		headers := w.Header()
-		headers.Set("Content-Type", "application/json")
-		w.Write(layer)
+		attribution := options.Tilesets.Get(tileset).Attribution
+		if attribution == "" {
+			attribution = options.Attribution
+		}
+		if attribution != "" {
+			if layer, err = attributeLayer(layer, attribution); err != nil {
+				return
+			}
+		}
+
+		contentType := options.ContentType
+		if contentType == "" {
+			contentType = LAYER_CONTENT_TYPE
+		}
+		w.Header().Set("Content-Type", contentType)
+		writeBody(w, r, http.StatusOK, layer)
 	}
 }
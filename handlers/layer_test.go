@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/geo-data/cesium-terrain-server/stores/fs"
+	"gopkg.in/rumicuna/mux.v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLayerZoomExtent(t *testing.T) {
+	root, tile := tileDir(t)
+	defer os.RemoveAll(root)
+	writeTile(t, root, "deep", 3, 0, 0, tile)
+	writeTile(t, root, "deep", 5, 0, 0, tile)
+
+	zoom := func(z uint64) *uint64 { return &z }
+	tests := []struct {
+		tileset    string
+		zoomExtent bool
+		min, max   *uint64
+	}{
+		{"test", false, nil, nil},
+		{"test", true, zoom(0), zoom(0)}, // a single zoom level from 0
+		{"deep", true, zoom(3), zoom(5)},
+	}
+
+	for _, test := range tests {
+		router := mux.NewRouter()
+		router.HandleFunc("/tilesets/{tileset:.+}/layer.json", LayerHandler(fs.New(root), LayerOptions{ZoomExtent: test.zoomExtent}))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/tilesets/"+test.tileset+"/layer.json", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", test.tileset, rec.Code)
+		}
+
+		var layer map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &layer); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]*uint64{"minzoom": test.min, "maxzoom": test.max} {
+			got, ok := layer[name]
+			if want == nil && ok {
+				t.Errorf("%s, zoom extent %v: got %s %v, want none", test.tileset, test.zoomExtent, name, got)
+			} else if want != nil && got != float64(*want) {
+				t.Errorf("%s, zoom extent %v: got %s %v, want %d", test.tileset, test.zoomExtent, name, got, *want)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"net/http"
+)
+
+// A metric exported by MetricsHandler.
+type metric struct {
+	name, kind, help string
+	value            func(stores.CacheStats) interface{}
+}
+
+var cacheMetrics = []metric{
+	{"cts_cache_size_bytes", "gauge", "The total size of the tiles in the cache.",
+		func(s stores.CacheStats) interface{} { return s.Size }},
+	{"cts_cache_max_size_bytes", "gauge", "The size of the cache beyond which tiles are evicted.",
+		func(s stores.CacheStats) interface{} { return s.MaxSize }},
+	{"cts_cache_entries", "gauge", "The number of tiles in the cache.",
+		func(s stores.CacheStats) interface{} { return s.Entries }},
+	{"cts_cache_hits_total", "counter", "The number of tiles served from the cache.",
+		func(s stores.CacheStats) interface{} { return s.Hits }},
+	{"cts_cache_misses_total", "counter", "The number of tiles loaded from the store behind the cache.",
+		func(s stores.CacheStats) interface{} { return s.Misses }},
+}
+
+// Return a name labelling a cache's metrics.
+func cacheName(cache stores.CacheStatter) string {
+	if s, ok := cache.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", cache)
+}
+
+// An HTTP handler which returns the statistics of tile caches in the
+// Prometheus text exposition format, each cache being labelled with its name.
+// This allows alerts on caches which are nearly full or are thrashing, and the
+// hit rate of a cache to be derived from its hits and misses.
+func MetricsHandler(caches ...stores.CacheStatter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := make([]stores.CacheStats, len(caches))
+		for i, cache := range caches {
+			stats[i] = cache.CacheStats()
+		}
+
+		var body bytes.Buffer
+		for _, m := range cacheMetrics {
+			fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+			for i, cache := range caches {
+				fmt.Fprintf(&body, "%s{cache=%q} %d\n", m.name, cacheName(cache), m.value(stats[i]))
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeBody(w, r, http.StatusOK, body.Bytes())
+	}
+}
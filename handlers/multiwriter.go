@@ -37,6 +37,16 @@ func (t *multiWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Flush flushes each writer which supports it, so that streamed responses
+// aren't buffered.
+func (t *multiWriter) Flush() {
+	for _, w := range t.writers {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
 // MultiWriter is inspired by io.MultiWriter
 func MultiWriter(writers ...http.ResponseWriter) http.ResponseWriter {
 	w := make([]http.ResponseWriter, len(writers))
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NegativeCache remembers tiles which are missing from a store so that
+// repeated requests for them can be answered without a store lookup. Entries
+// expire after a TTL which is randomly jittered so that entries added together
+// don't all expire at once, causing a burst of lookups.
+type NegativeCache struct {
+	ttl     time.Duration
+	jitter  float64 // the maximum fraction of ttl by which expiry varies
+	max     int     // the maximum number of entries
+	lock    sync.Mutex
+	entries map[string]*negativeEntry
+	expiry  expiryQueue // the entries ordered by expiry time, soonest first
+	rand    *rand.Rand
+}
+
+type negativeEntry struct {
+	key    string
+	expiry time.Time
+	index  int // the position in the heap
+}
+
+// expiryQueue implements heap.Interface.
+type expiryQueue []*negativeEntry
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiry.Before(q[j].expiry) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(*negativeEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// NewNegativeCache returns a NegativeCache holding up to max entries, each
+// expiring after ttl plus or minus up to jitter percent of ttl.
+func NewNegativeCache(ttl time.Duration, jitter float64, max int) *NegativeCache {
+	return &NegativeCache{
+		ttl:     ttl,
+		jitter:  jitter / 100,
+		max:     max,
+		entries: make(map[string]*negativeEntry),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Missing returns true if the key is known to be missing.
+func (this *NegativeCache) Missing(key string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(entry.expiry) {
+		this.remove(entry)
+		return false
+	}
+	return true
+}
+
+// Add records the key as missing. If the cache is full the key is only added
+// if space can be made by removing expired entries, which are found in order
+// of expiry so that adding a key doesn't scan the whole cache.
+func (this *NegativeCache) Add(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for len(this.expiry) > 0 && now.After(this.expiry[0].expiry) {
+		this.remove(this.expiry[0])
+	}
+
+	jitter := (this.rand.Float64()*2 - 1) * this.jitter * float64(this.ttl)
+	expiry := now.Add(this.ttl + time.Duration(jitter))
+
+	if entry, ok := this.entries[key]; ok {
+		entry.expiry = expiry
+		heap.Fix(&this.expiry, entry.index)
+		return
+	}
+	if len(this.entries) >= this.max {
+		return
+	}
+
+	entry := &negativeEntry{key: key, expiry: expiry}
+	heap.Push(&this.expiry, entry)
+	this.entries[key] = entry
+}
+
+// Remove forgets that the key is missing.
+func (this *NegativeCache) Remove(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if entry, ok := this.entries[key]; ok {
+		this.remove(entry)
+	}
+}
+
+// Remove an entry from the cache.
+func (this *NegativeCache) remove(entry *negativeEntry) {
+	heap.Remove(&this.expiry, entry.index)
+	delete(this.entries, entry.key)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	cache := NewNegativeCache(50*time.Millisecond, 10, 3)
+	for i := 0; i < 4; i++ {
+		cache.Add(strconv.Itoa(i))
+	}
+
+	// The cache is full so the last key isn't added.
+	for i, missing := range []bool{true, true, true, false} {
+		if cache.Missing(strconv.Itoa(i)) != missing {
+			t.Errorf("key %d: got missing %v, want %v", i, !missing, missing)
+		}
+	}
+
+	// Removing a key makes room for another.
+	cache.Remove("1")
+	cache.Add("3")
+	for i, missing := range []bool{true, false, true, true} {
+		if cache.Missing(strconv.Itoa(i)) != missing {
+			t.Errorf("key %d after removal: got missing %v, want %v", i, !missing, missing)
+		}
+	}
+
+	// Expired entries are dropped to make room.
+	time.Sleep(60 * time.Millisecond)
+	cache.Add("4")
+	if len(cache.entries) != 1 || len(cache.expiry) != 1 || !cache.Missing("4") {
+		t.Errorf("got %d entries, want only the new key", len(cache.entries))
+	}
+	if cache.Missing("0") {
+		t.Error("an expired key is missing")
+	}
+}
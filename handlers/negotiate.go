@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type formatKey struct{}
+
+// TileFormat wraps a tile handler so that it serves the representation of the
+// tile with the given media type, ignoring the `Accept` header. This allows
+// clients which can't set headers to choose a representation by the extension
+// of the url e.g. `.qmesh` for quantized-mesh.
+func TileFormat(mediaType string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), formatKey{}, mediaType)))
+	}
+}
+
+// Return the media type requested with TileFormat, if any.
+func tileFormat(r *http.Request) (mediaType string, ok bool) {
+	mediaType, ok = r.Context().Value(formatKey{}).(string)
+	return
+}
+
+// Return the file extension of tiles with a media type, as in their urls.
+func tileExtension(mediaType string) string {
+	if mediaType == stores.QUANTIZED_MESH_MEDIA_TYPE {
+		return ".qmesh"
+	}
+	return ".terrain"
+}
+
+type encodingKey struct{}
+
+// EncodingOverride wraps a tile handler so that a content encoding requested
+// in the param query parameter, `identity` or `gzip`, overrides the
+// `Accept-Encoding` header. This serves clients which can't set the header
+// (e.g. some WebAssembly fetch shims), tiles being decompressed or compressed
+// as needed.
+func EncodingOverride(param string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get(param)
+		if encoding == "" {
+			handler(w, r)
+			return
+		}
+		if encoding != "identity" && encoding != "gzip" {
+			http.Error(w, fmt.Sprintf("The encoding `%s` is not supported: choose identity or gzip", encoding), http.StatusBadRequest)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), encodingKey{}, encoding))
+		r.Header = r.Header.Clone()
+		r.Header.Set("Accept-Encoding", encoding)
+		handler(w, r)
+	}
+}
+
+// Return the encoding requested with EncodingOverride, if any.
+func requiredEncoding(r *http.Request) string {
+	encoding, _ := r.Context().Value(encodingKey{}).(string)
+	return encoding
+}
+
+// A media range parsed from an `Accept` header.
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// Parse an `Accept` header into its media ranges. Parameters other than the
+// `q` quality value are ignored.
+func parseAccept(accept string) (ranges []mediaRange) {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				quality = q
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mediaType, quality})
+	}
+	return
+}
+
+// Return how specifically the media range matches a media type: an exact
+// match beats `type/*` which beats `*/*`. Zero means no match.
+func (this mediaRange) match(mediaType string) (specificity int) {
+	switch {
+	case this.mediaType == mediaType:
+		return 3
+	case strings.HasSuffix(this.mediaType, "/*") &&
+		strings.HasPrefix(mediaType, this.mediaType[:len(this.mediaType)-1]):
+		return 2
+	case this.mediaType == "*/*":
+		return 1
+	}
+	return 0
+}
+
+// Return the quality the client assigns to a media type using the most
+// specific matching media range. -1 means the media type is not matched.
+func quality(ranges []mediaRange, mediaType string) float64 {
+	best, q := 0, -1.0
+	for _, r := range ranges {
+		if s := r.match(mediaType); s > best {
+			best, q = s, r.quality
+		}
+	}
+	return q
+}
+
+// negotiate returns the media type from the available variants which best
+// satisfies the `Accept` header. Ties are resolved by the order of the
+// variants. An empty header accepts the first variant and an empty string is
+// returned if nothing is acceptable.
+func negotiate(accept string, variants []string) (chosen string) {
+	if len(variants) == 0 {
+		return
+	}
+
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return variants[0]
+	}
+
+	best := 0.0
+	for _, variant := range variants {
+		if q := quality(ranges, strings.ToLower(variant)); q > best {
+			best, chosen = q, variant
+		}
+	}
+	return
+}
+
+// acceptsEncoding returns true if an `Accept-Encoding` header permits a
+// content coding, either by name or via the `*` wildcard.
+func acceptsEncoding(header, coding string) bool {
+	q := -1.0
+	for _, r := range parseAccept(header) {
+		if r.mediaType == coding || (coding == "gzip" && r.mediaType == "x-gzip") {
+			q = r.quality
+			break
+		} else if r.mediaType == "*" {
+			q = r.quality
+		}
+	}
+	return q > 0
+}
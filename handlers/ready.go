@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness records whether the server is ready to serve traffic, e.g. once
+// startup tasks priming its caches have finished. It is safe for concurrent
+// use.
+type Readiness struct {
+	ready int32
+}
+
+// SetReady marks the server as ready.
+func (this *Readiness) SetReady() {
+	atomic.StoreInt32(&this.ready, 1)
+}
+
+// Ready returns true once SetReady has been called.
+func (this *Readiness) Ready() bool {
+	return atomic.LoadInt32(&this.ready) == 1
+}
+
+// An HTTP handler for load balancer readiness checks, responding with 503
+// Service Unavailable until the server is ready.
+func (this *Readiness) Handler(w http.ResponseWriter, r *http.Request) {
+	headers := w.Header()
+	headers.Set("Content-Type", "text/plain; charset=utf-8")
+	headers.Set("Cache-Control", "no-store")
+	if !this.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// DefaultRobots is a `robots.txt` policy which discourages well behaved
+// crawlers from crawling the server at all: there is nothing for them to
+// index, and enumerating tiles would load the server.
+var DefaultRobots = []byte("User-agent: *\nDisallow: /\n")
+
+// An HTTP handler which responds to requests for a favicon with no content,
+// so that browsers visiting the server don't cause 404 errors.
+func FaviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// An HTTP handler which returns a `robots.txt` resource.
+func RobotsHandler(robots []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		headers := w.Header()
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(robots)
+	}
+}
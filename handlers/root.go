@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// Describes the server at the root url.
+type rootInfo struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Tilesets string `json:"tilesets,omitempty"` // the url of the index of tilesets
+}
+
+var rootTemplate = template.Must(template.New("root").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Version {{.Version}}.{{if .Tilesets}} Terrain tilesets are listed at <a href="{{.Tilesets}}">{{.Tilesets}}</a>.{{end}}</p>
+</body>
+</html>
+`))
+
+// An HTTP handler for the root url which describes the server: its name,
+// version and the url of the index of tilesets (see TilesetsHandler), if there
+// is one, as a JSON object or, if html is true, an HTML page. The response is
+// rendered once, when the handler is created.
+func RootHandler(name, version, tilesetsUrl string, html bool) func(http.ResponseWriter, *http.Request) {
+	info := rootInfo{
+		Name:     name,
+		Version:  version,
+		Tilesets: tilesetsUrl,
+	}
+
+	var (
+		body        []byte
+		contentType string
+	)
+	if html {
+		var buf bytes.Buffer
+		rootTemplate.Execute(&buf, info) // the template can't fail with this data
+		body, contentType = buf.Bytes(), "text/html; charset=utf-8"
+	} else {
+		body, _ = json.MarshalIndent(info, "", "  ")
+		contentType = "application/json"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		writeBody(w, r, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/geo-data/cesium-terrain-server/stores/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRootLinksToTilesets(t *testing.T) {
+	root, _ := tileDir(t)
+	defer os.RemoveAll(root)
+	writeTile(t, root, "private", 0, 0, 0, []byte("tile"))
+	config := Tilesets{"private": &Tileset{Keys: []string{"secret"}}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tilesets/", TilesetsHandler(fs.New(root), "/tilesets", config))
+	mux.HandleFunc("/", RootHandler("test", "1.0", "/tilesets/", false))
+
+	var info rootInfo
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link from the root url leads to the index of tilesets.
+	var index struct{ Tilesets []catalogEntry }
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", info.Tilesets, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got status %d", info.Tilesets, w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Tilesets) != 1 || index.Tilesets[0] != (catalogEntry{"test", "/tilesets/test"}) {
+		t.Errorf("GET %s: got tilesets %v", info.Tilesets, index.Tilesets)
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// LogSampler selects one in every N events for logging, keeping a record of
+// frequent events without logging every occurrence.
+type LogSampler struct {
+	rate  uint64
+	count uint64
+}
+
+// NewLogSampler returns a LogSampler selecting one in every rate events.
+func NewLogSampler(rate uint64) *LogSampler {
+	if rate == 0 {
+		rate = 1
+	}
+	return &LogSampler{rate: rate}
+}
+
+// Sample returns true if the current event should be logged. It is safe for
+// concurrent use.
+func (this *LogSampler) Sample() bool {
+	return (atomic.AddUint64(&this.count, 1)-1)%this.rate == 0
+}
+
+// Rate returns the sampling rate.
+func (this *LogSampler) Rate() uint64 {
+	return this.rate
+}
+
+// RandomSampler selects events at random with a probability between 0 (none)
+// and 1 (all).
+type RandomSampler float64
+
+// Sample returns true if the current event is selected.
+func (this RandomSampler) Sample() bool {
+	return this > 0 && rand.Float64() < float64(this)
+}
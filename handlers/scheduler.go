@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Scheduler limits the number of tile lookups running concurrently. When the
+// limit is reached waiting lookups are admitted in order of priority, lowest
+// value first. Prioritising by zoom level means the low zoom tiles needed to
+// render the globe are served first during load spikes.
+type Scheduler struct {
+	lock    sync.Mutex
+	limit   int
+	active  int
+	seq     uint64 // orders waiters of equal priority first come first served
+	waiting waitQueue
+}
+
+type waiter struct {
+	priority uint64
+	seq      uint64
+	index    int // the position in the heap
+	ready    chan struct{}
+}
+
+// waitQueue implements heap.Interface.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority == q[j].priority {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].priority < q[j].priority
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// NewScheduler returns a Scheduler allowing limit concurrent lookups.
+func NewScheduler(limit int) *Scheduler {
+	return &Scheduler{
+		limit: limit,
+	}
+}
+
+// Acquire blocks until a lookup with the given priority may proceed, in which
+// case Release must be called when it completes. An error is returned if the
+// context is done before then.
+func (this *Scheduler) Acquire(ctx context.Context, priority uint64) error {
+	this.lock.Lock()
+	if this.active < this.limit {
+		this.active++
+		this.lock.Unlock()
+		return nil
+	}
+
+	w := &waiter{
+		priority: priority,
+		seq:      this.seq,
+		ready:    make(chan struct{}),
+	}
+	this.seq++
+	heap.Push(&this.waiting, w)
+	this.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		if w.index < 0 {
+			// admitted whilst being cancelled: pass the slot on
+			this.release()
+		} else {
+			heap.Remove(&this.waiting, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// Release ends a lookup, admitting the highest priority waiter.
+func (this *Scheduler) Release() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.release()
+}
+
+func (this *Scheduler) release() {
+	if this.waiting.Len() > 0 {
+		w := heap.Pop(&this.waiting).(*waiter)
+		close(w.ready)
+		return
+	}
+	this.active--
+}
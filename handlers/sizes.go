@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// The upper bounds in bytes of the tile size histogram buckets. Larger tiles
+// are counted in a final overflow bucket.
+var SIZE_BUCKETS = []Bytes{512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072, 262144}
+
+// The maximum zoom level recorded separately: deeper levels are counted with it.
+const MAX_STATS_ZOOM = 31
+
+// SizeStats records a histogram of the sizes of the tiles sent to clients for
+// each zoom level. It is safe for concurrent use.
+type SizeStats struct {
+	counts [MAX_STATS_ZOOM + 1][]uint64 // per zoom level bucket counts
+	bytes  [MAX_STATS_ZOOM + 1]uint64   // per zoom level bytes sent
+}
+
+func NewSizeStats() *SizeStats {
+	stats := &SizeStats{}
+	for i := range stats.counts {
+		stats.counts[i] = make([]uint64, len(SIZE_BUCKETS)+1)
+	}
+	return stats
+}
+
+// Record a tile of the given size sent at a zoom level.
+func (this *SizeStats) Record(zoom uint64, size int) {
+	if zoom > MAX_STATS_ZOOM {
+		zoom = MAX_STATS_ZOOM
+	}
+
+	bucket := len(SIZE_BUCKETS)
+	for i, bound := range SIZE_BUCKETS {
+		if Bytes(size) <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	atomic.AddUint64(&this.counts[zoom][bucket], 1)
+	atomic.AddUint64(&this.bytes[zoom], uint64(size))
+}
+
+// The histogram of a single zoom level.
+type zoomSizes struct {
+	Count  uint64   `json:"count"`
+	Bytes  uint64   `json:"bytes"`
+	Counts []uint64 `json:"counts"` // the count in each bucket
+}
+
+// An HTTP handler which returns the tile size histograms as JSON. Only zoom
+// levels at which tiles have been sent are included.
+func (this *SizeStats) Handler(w http.ResponseWriter, r *http.Request) {
+	zooms := make(map[string]zoomSizes)
+	for zoom := range this.counts {
+		sizes := zoomSizes{
+			Bytes:  atomic.LoadUint64(&this.bytes[zoom]),
+			Counts: make([]uint64, len(SIZE_BUCKETS)+1),
+		}
+		for i := range sizes.Counts {
+			sizes.Counts[i] = atomic.LoadUint64(&this.counts[zoom][i])
+			sizes.Count += sizes.Counts[i]
+		}
+
+		if sizes.Count > 0 {
+			zooms[strconv.Itoa(zoom)] = sizes
+		}
+	}
+
+	body, err := json.MarshalIndent(struct {
+		Buckets []Bytes              `json:"buckets"`
+		Zooms   map[string]zoomSizes `json:"zooms"`
+	}{SIZE_BUCKETS, zooms}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Cache-Control", "no-store")
+	w.Write(body)
+}
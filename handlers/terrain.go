@@ -1,66 +1,712 @@
 package handlers
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/geo-data/cesium-terrain-server/assets"
 	"github.com/geo-data/cesium-terrain-server/log"
 	"github.com/geo-data/cesium-terrain-server/stores"
-	"gopkg.in/rumicuna/mux.v2"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// TerrainOptions customises the behaviour of TerrainHandler.
+type TerrainOptions struct {
+	StrictGzip   bool // verify the gzip stream of each tile before sending it
+	StrictAccept bool // respond with 406 if no format is acceptable to the client
+	LenientCoord bool // ignore whitespace around tile coordinates
+	DebugHeaders bool // add headers describing how the tile was served
+	ServerTiming bool // add a Server-Timing header timing the store lookup
+
+	// If set, tiles outside of a tileset's coverage mask are served as blank
+	// tiles without consulting the store.
+	Coverage *CoverageCache
+
+	// If set, tiles missing from a tileset's list of available tiles are
+	// treated as missing without consulting the store.
+	Existence *ExistenceCache
+
+	// If set, missing tiles are remembered so that subsequent requests for
+	// them are answered without consulting the store.
+	Negative *NegativeCache
+
+	Tilesets Tilesets // per tileset configuration
+
+	// Tiles smaller than this are decompressed and sent without a
+	// Content-Encoding, saving clients the cost of inflating them. Zero
+	// disables this.
+	GzipMinSize Bytes
+	// The maximum size of a tile when it is decompressed.
+	MaxDecompressed Bytes
+	// Recompress gzipped tiles made up of more than one gzip member as a
+	// single member, for clients which only read the first.
+	NormalizeGzip bool
+	// A preset dictionary of data common to tiles (e.g. concatenated
+	// uncompressed tiles). Tiles which the server compresses itself, or
+	// would otherwise send uncompressed, are compressed with it for clients
+	// accepting DICTIONARY_ENCODING. Other clients can't decode these so are
+	// unaffected, and stored gzipped tiles are still passed through as is.
+	GzipDictionary []byte
+
+	// The status returned for missing tiles: http.StatusNotFound (the
+	// default) or http.StatusNoContent for clients which treat a 404 as an
+	// error.
+	MissingStatus int
+
+	// If set, this tile is sent with MissingTileStatus in response to
+	// requests for missing tiles, other than root tiles which are blank.
+	MissingTile       []byte
+	MissingTileStatus int
+
+	ContentMD5 bool // add a Content-MD5 header to tile responses
+
+	// If set, requests waiting longer than this for the store to load a tile
+	// are answered as TimeoutResponse directs.
+	StoreTimeout time.Duration
+	// How requests timing out are answered: one of the TIMEOUT_ responses,
+	// TIMEOUT_ERROR if not set.
+	TimeoutResponse string
+
+	// When missing tiles are served as blank tiles, unless overridden by the
+	// tileset's configuration: one of the BLANK_ policies, BLANK_ROOT if not
+	// set.
+	Blank string
+
+	// If set, clients can give the time they are prepared to wait for a tile
+	// in this request header e.g. `X-Request-Deadline: 250`, up to
+	// MaxDeadline (if set). Requests exceeding it are answered as
+	// TimeoutResponse directs.
+	DeadlineHeader string
+	MaxDeadline    time.Duration
+
+	// If set, store lookups are limited by the scheduler, lower zoom levels
+	// taking priority.
+	Scheduler *Scheduler
+
+	// If set, requests with a `Cache-Control: no-cache` header or a
+	// `nocache=1` query parameter skip the coverage, existence and negative
+	// caches and are read from the store.
+	AllowBypass bool
+
+	// If set, a sample of requests for missing tiles is logged.
+	MissingLog *LogSampler
+
+	// Precompressed content encodings, e.g. `br`, requested from the store
+	// when the client accepts them.
+	Precompressed []string
+
+	// The fraction of requests for which details of how the tile was served
+	// are logged.
+	DebugSample RandomSampler
+
+	// If set, the sizes of the tiles sent are recorded.
+	Sizes *SizeStats
+
+	// If set, gzipped tiles decompressed for clients which don't accept gzip
+	// are cached for reuse.
+	Inflated *InflateCache
+
+	// If set, the time each tileset was last requested is recorded.
+	Access *AccessTimes
+
+	// Send tiles which don't need to be changed straight from their files if
+	// the store keeps them in files, instead of reading them into memory.
+	SendFiles bool
+}
+
+// Return true if the request asks for caches to be bypassed.
+func wantsBypass(r *http.Request) bool {
+	if r.URL.Query().Get("nocache") == "1" {
+		return true
+	}
+
+	// HTTP/1.0 clients ask with Pragma instead of Cache-Control.
+	if strings.ToLower(strings.TrimSpace(r.Header.Get("Pragma"))) == "no-cache" {
+		return true
+	}
+
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.ToLower(strings.TrimSpace(directive)) == "no-cache" {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the blank tile policy of a tileset.
+func (this *TerrainOptions) blankPolicy(tileset string) string {
+	if policy := this.Tilesets.Get(tileset).Blank; policy != "" {
+		return policy
+	}
+	return this.Blank
+}
+
+// Return true if a missing tile should be served as a blank tile.
+func (this *TerrainOptions) blank(tileset string, t *stores.Terrain) bool {
+	switch this.blankPolicy(tileset) {
+	case BLANK_ALWAYS:
+		return true
+	case BLANK_NEVER:
+		return false
+	}
+	return t.IsRoot()
+}
+
+// Responses to requests for which the store takes too long to load a tile.
+const (
+	TIMEOUT_ERROR       = "error"       // 504 Gateway Timeout
+	TIMEOUT_UNAVAILABLE = "unavailable" // 503 Service Unavailable, inviting a retry
+	TIMEOUT_BLANK       = "blank"       // a blank tile which must not be cached
+)
+
+// ValidateTimeoutResponse checks a response to requests which time out.
+func ValidateTimeoutResponse(response string) error {
+	switch response {
+	case TIMEOUT_ERROR, TIMEOUT_UNAVAILABLE, TIMEOUT_BLANK:
+		return nil
+	}
+	return fmt.Errorf("bad timeout response %s: choose one of error, unavailable, blank", response)
+}
+
+// Return the time the client is prepared to wait for a tile, as given by the
+// deadline header, limited to MaxDeadline. The header holds a number of
+// milliseconds or a duration such as `250ms`.
+func (this *TerrainOptions) deadline(r *http.Request) (budget time.Duration, ok bool) {
+	if this.DeadlineHeader == "" {
+		return
+	}
+
+	value := strings.TrimSpace(r.Header.Get(this.DeadlineHeader))
+	if value == "" {
+		return
+	}
+
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		budget = time.Duration(ms) * time.Millisecond
+	} else if budget, err = time.ParseDuration(value); err != nil {
+		return // ignore malformed deadlines
+	}
+
+	if budget <= 0 {
+		budget = time.Nanosecond // the client has already given up
+	} else if this.MaxDeadline > 0 && budget > this.MaxDeadline {
+		budget = this.MaxDeadline
+	}
+	return budget, true
+}
+
+// Run a store lookup once the scheduler (if any) allows it, giving up when
+// StoreTimeout or the client's deadline passes. Lookups are prioritised by
+// zoom level. The duration of the lookup is returned, and recorded in a
+// Server-Timing header if timing is enabled: if timings is set and returns
+// the durations of the lookup in each store tier (see stores.TimeTile), each
+// is recorded. discard is called if the lookup is abandoned and then succeeds
+// (see lookupDeadline).
+func (this *TerrainOptions) lookup(w http.ResponseWriter, r *http.Request, store stores.Storer, zoom uint64, lookup func(context.Context) error, discard func(), timings func() []stores.Timing) (elapsed time.Duration, err error) {
+	ctx := r.Context()
+	timeout := this.StoreTimeout
+	if budget, ok := this.deadline(r); ok && (timeout == 0 || budget < timeout) {
+		timeout = budget
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	release := func() {}
+	if this.Scheduler != nil {
+		if err = this.Scheduler.Acquire(ctx, zoom); err == context.DeadlineExceeded {
+			err = ErrTimeout
+		}
+		if err != nil {
+			return
+		}
+		release = this.Scheduler.Release
+	}
+
+	start := time.Now()
+	completed := true // has the lookup finished?
+	if timeout > 0 {
+		// the scheduler slot is held until an abandoned lookup completes
+		err = lookupDeadline(ctx, lookup, discard, release)
+		completed = ctx.Err() == nil
+	} else {
+		defer release()
+		err = lookup(ctx)
+	}
+	elapsed = time.Since(start)
+
+	if this.ServerTiming {
+		var tiers []stores.Timing
+		if completed && timings != nil {
+			tiers = timings()
+		}
+		if len(tiers) == 0 {
+			tiers = []stores.Timing{{Store: storeName(store), Duration: elapsed}}
+		}
+		for _, tier := range tiers {
+			ms := float64(tier.Duration) / float64(time.Millisecond)
+			w.Header().Add("Server-Timing", fmt.Sprintf("%s;dur=%.3f", timingName(tier.Store), ms))
+		}
+	}
+	return
+}
+
+// Return the Server-Timing metric name for a store, which must be an HTTP
+// token: other characters are replaced e.g. `fs[1]` becomes `fs-1`.
+func timingName(store string) string {
+	var name []byte
+	for i := 0; i < len(store); i++ {
+		c := store[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' {
+			name = append(name, c)
+		} else if len(name) > 0 && name[len(name)-1] != '-' {
+			name = append(name, '-')
+		}
+	}
+	if name := strings.TrimSuffix(string(name), "-"); name != "" {
+		return name
+	}
+	return "store"
+}
+
+// Load a tile from a store (see lookup). The store loads into a copy of the
+// tile, which is discarded if the load is abandoned.
+func (this *TerrainOptions) load(w http.ResponseWriter, r *http.Request, store stores.Storer, tileset string, t *stores.Terrain) (elapsed time.Duration, err error) {
+	loaded := *t
+	elapsed, err = this.lookup(w, r, store, t.Z, func(ctx context.Context) error {
+		return loadTile(ctx, store, tileset, &loaded)
+	}, nil, func() []stores.Timing {
+		return loaded.Timings
+	})
+	if err == nil {
+		*t = loaded
+	}
+	return
+}
+
+// Return the name of the store which loaded a tile.
+func tileSource(store stores.Storer, t *stores.Terrain) string {
+	if t.Source != "" {
+		return t.Source
+	}
+	return storeName(store)
+}
+
+// Decompress a gzipped tile body, using the InflateCache if there is one. The
+// body is that of the tile unless it has been modified.
+func (this *TerrainOptions) gunzip(body []byte, t *stores.Terrain, modified bool) ([]byte, error) {
+	if this.Inflated == nil {
+		return Gunzip(body, this.MaxDecompressed)
+	}
+
+	digest := t.MD5()
+	if modified {
+		sum := md5.Sum(body)
+		digest = sum[:]
+	}
+	return this.Inflated.Gunzip(string(digest), body, this.MaxDecompressed)
+}
+
+// Return the media types in which a tile is available, in order of preference:
+// that of the tileset's format if one is configured, otherwise those offered
+// by the store.
+func (this *TerrainOptions) variants(store stores.Storer, tileset string, t *stores.Terrain) ([]string, error) {
+	if config := this.Tilesets.Get(tileset); config.Format != "" {
+		return []string{config.MediaType()}, nil
+	}
+	if vs, ok := store.(stores.VariantStorer); ok {
+		return vs.Variants(tileset, t)
+	}
+	return nil, nil
+}
+
+// Set the headers of a tile response.
+func tileHeaders(w http.ResponseWriter, r *http.Request, tileset string, t *stores.Terrain, encoding string, options *TerrainOptions) http.Header {
+	headers := w.Header()
+	headers.Set("Content-Type", t.MediaType)
+	headers.Add("Vary", "Accept")
+	headers.Add("Vary", "Accept-Encoding")
+	if encoding != "identity" {
+		headers.Set("Content-Encoding", encoding)
+	}
+	headers.Set("Content-Disposition", "attachment;filename="+strconv.FormatUint(t.Y, 10)+tileExtension(t.MediaType))
+	config := options.Tilesets.Get(tileset)
+	for name, value := range config.Headers {
+		headers.Set(name, value)
+	}
+	if cc := headers.Get("Cache-Control"); options.Tilesets.Restricted(tileset) && !strings.Contains(cc, "private") {
+		headers.Set("Cache-Control", strings.TrimSuffix("private, "+cc, ", ")) // see RestrictTilesets
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		http10CacheHeaders(headers)
+		// Say that the connection closes after the response, as HTTP/1.0
+		// clients can't otherwise assume it.
+		if !http10KeepAlive(r) {
+			headers.Set("Connection", "close")
+		}
+	}
+	return headers
+}
+
+// A ResponseWriter which sets the Content-Length of complete (200) responses
+// sent by http.ServeContent, which leaves it unset when a Content-Encoding is
+// set: such responses would otherwise be chunked, or for HTTP/1.0 clients end
+// by closing the connection.
+type contentLengthWriter struct {
+	http.ResponseWriter
+	length int64
+}
+
+func (this *contentLengthWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		this.Header().Set("Content-Length", strconv.FormatInt(this.length, 10))
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom lets the file be sent with the underlying writer's ReadFrom (e.g.
+// using sendfile).
+func (this *contentLengthWriter) ReadFrom(src io.Reader) (int64, error) {
+	if writer, ok := this.ResponseWriter.(io.ReaderFrom); ok {
+		return writer.ReadFrom(src)
+	}
+	return io.Copy(this.ResponseWriter, src)
+}
+
+// Open the file of a tile which can be sent straight from it, letting the
+// kernel copy it to the client (e.g. with sendfile) rather than reading it into
+// memory. This is only possible for tiles which are sent unchanged: a nil file
+// is returned if the tile must be loaded instead. The file is opened as a
+// lookup, subject to the same limits as loading the tile.
+func (this *TerrainOptions) openTileFile(w http.ResponseWriter, r *http.Request, store stores.Storer, tileset string, t *stores.Terrain) (file *os.File, encoding string, elapsed time.Duration, err error) {
+	fstore, ok := store.(stores.FileStorer)
+	if !ok || this.StrictGzip || this.NormalizeGzip || this.ContentMD5 || this.GzipMinSize > 0 ||
+		len(t.AcceptEncodings) > 0 || len(this.Tilesets.Get(tileset).Transforms) > 0 ||
+		(this.GzipDictionary != nil && acceptsEncoding(r.Header.Get("Accept-Encoding"), DICTIONARY_ENCODING)) {
+		return
+	}
+
+	var opened *os.File
+	if elapsed, err = this.lookup(w, r, store, t.Z, func(ctx context.Context) (err error) {
+		opened, err = fstore.TileFile(tileset, t)
+		return
+	}, func() {
+		opened.Close()
+	}, nil); err != nil {
+		return
+	}
+	file = opened
+
+	encoding = this.Tilesets.Get(tileset).Encoding
+	if encoding == "" {
+		magic := make([]byte, SNIFF_LENGTH)
+		n, _ := file.ReadAt(magic, 0)
+		encoding = sniffEncoding(magic[:n])
+	}
+	if (encoding == "gzip" || encoding == "zstd") && !acceptsEncoding(r.Header.Get("Accept-Encoding"), encoding) {
+		file.Close() // the tile must be decompressed
+		file = nil
+	} else if encoding == "identity" && requiredEncoding(r) == "gzip" {
+		file.Close() // the tile must be compressed
+		file = nil
+	}
+	return
+}
+
+// Load the blank tile into a terrain tile.
+func blankTile(t *stores.Terrain) error {
+	data, err := assets.Asset("data/smallterrain-blank.terrain")
+	if err != nil {
+		return err
+	}
+
+	if err = t.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	// The embedded tile is gzipped but its encoding is detected so that the
+	// Content-Encoding header stays accurate should the asset be replaced.
+	t.MediaType = stores.HEIGHTMAP_MEDIA_TYPE
+	t.Encoding = sniffEncoding(data)
+	return nil
+}
+
+// Send the custom tile for missing tiles.
+func sendMissingTile(w http.ResponseWriter, r *http.Request, options TerrainOptions) {
+	body := options.MissingTile
+	encoding := sniffEncoding(body)
+	if encoding == "gzip" && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+		var err error
+		if body, err = Gunzip(body, options.MaxDecompressed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encoding = "identity"
+	} else if encoding == "zstd" && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "zstd") {
+		var err error
+		if body, encoding, err = transcodeZstd(r, body, &options); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Type", stores.HEIGHTMAP_MEDIA_TYPE)
+	headers.Add("Vary", "Accept-Encoding")
+	if encoding != "identity" {
+		headers.Set("Content-Encoding", encoding)
+	}
+	// The tile stands in for a missing tile, so it mustn't be cached as the
+	// real tile, e.g. when sent with a 200 status.
+	headers.Set("Cache-Control", "no-store")
+	writeBody(w, r, options.MissingTileStatus, body)
+}
+
 // An HTTP handler which returns a terrain tile resource
-func TerrainHandler(store stores.Storer) func(http.ResponseWriter, *http.Request) {
+func TerrainHandler(store stores.Storer, options TerrainOptions) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
-			t   stores.Terrain
-			err error
+			t       stores.Terrain
+			err     error
+			from    string        // the source of the tile
+			elapsed time.Duration // the duration of the store lookup
 		)
 
+		if options.DebugSample.Sample() {
+			start := time.Now()
+			defer func() {
+				log.Notice(fmt.Sprintf("sampled request %s: source=%s store=%s encoding=%s lookup=%s total=%s error=%v",
+					r.URL.Path, from, storeName(store), t.Encoding, elapsed, time.Since(start), err))
+			}()
+		}
+
 		defer func() {
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err == context.Canceled {
+				return // the client has gone away
+			} else if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
 				log.Err(err.Error())
 			}
 		}()
 
+		// Record which store satisfied the request, if any.
+		source := func(name string) {
+			from = name
+			recordSource(r, name)
+			if options.DebugHeaders {
+				w.Header().Set("X-Tile-Source", name)
+			}
+		}
+
+		// Respond to a request for a tile that doesn't exist
+		missing := func() {
+			source("miss")
+			if options.MissingLog != nil && options.MissingLog.Sample() {
+				log.Notice(fmt.Sprintf("tile not found: %s (1 in %d logged)", r.URL.Path, options.MissingLog.Rate()))
+			}
+			if options.MissingTile != nil {
+				sendMissingTile(w, r, options)
+				return
+			}
+			if options.MissingStatus == http.StatusNoContent {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			http.Error(w, errors.New("The terrain tile does not exist").Error(), http.StatusNotFound)
+		}
+
 		// get the tile coordinate from the URL
-		vars := mux.Vars(r)
-		err = t.ParseCoord(vars["x"], vars["y"], vars["z"])
+		tileset := TilesetName(r)
+		if options.Access != nil {
+			options.Access.Record(tileset)
+		}
+		x, y, z := TileCoord(r)
+		if options.LenientCoord {
+			x, y, z = strings.TrimSpace(x), strings.TrimSpace(y), strings.TrimSpace(z)
+		}
+		err = t.ParseCoord(x, y, z)
 		if err != nil {
 			return
 		}
 
-		// Try and get a tile from the store
-		err = store.Tile(vars["tileset"], &t)
-		if err == stores.ErrNoItem {
-			if store.TilesetStatus(vars["tileset"]) == stores.NOT_FOUND {
+		// Choose the representation of the tile best suited to the client,
+		// unless the url names one
+		accept := r.Header.Get("Accept")
+		format, byExtension := tileFormat(r)
+		if byExtension {
+			accept = format
+		}
+		var variants []string
+		if variants, err = options.variants(store, tileset, &t); err != nil {
+			return
+		}
+		t.MediaType = negotiate(accept, variants)
+		if t.MediaType == "" && len(variants) > 0 {
+			if options.StrictAccept && !byExtension {
+				http.Error(w,
+					fmt.Sprintf("The terrain tile is only available as %s", strings.Join(variants, ", ")),
+					http.StatusNotAcceptable)
+				return
+			}
+
+			// be lenient and fall back to the preferred variant
+			t.MediaType = variants[0]
+		}
+		if t.MediaType == "" {
+			t.MediaType = stores.HEIGHTMAP_MEDIA_TYPE
+		}
+		if byExtension && t.MediaType != format {
+			http.Error(w, fmt.Sprintf("The terrain tile is not available as %s", format), http.StatusNotFound)
+			return
+		}
+
+		bypass := options.AllowBypass && wantsBypass(r)
+
+		for _, encoding := range options.Precompressed {
+			if acceptsEncoding(r.Header.Get("Accept-Encoding"), encoding) {
+				t.AcceptEncodings = append(t.AcceptEncodings, encoding)
+			}
+		}
+
+		covered := true
+		if options.Coverage != nil && !bypass {
+			covered = options.Coverage.Covers(tileset, &t)
+		}
+
+		// Tiles recently found to be missing don't need to be looked up again
+		key := fmt.Sprintf("%s/%d/%d/%d", tileset, t.Z, t.X, t.Y)
+		if covered && !bypass && options.Negative != nil && options.Negative.Missing(key) {
+			missing()
+			return
+		}
+
+		// Tiles not listed as available are missing, although root tiles are
+		// still served as blank tiles.
+		if covered && !bypass && options.Existence != nil && !options.Existence.Exists(tileset, &t) {
+			if !options.blank(tileset, &t) {
+				missing()
+				return
+			}
+			covered = false
+		}
+
+		if covered && options.SendFiles {
+			var (
+				file     *os.File
+				info     os.FileInfo
+				encoding string
+			)
+			file, encoding, elapsed, err = options.openTileFile(w, r, store, tileset, &t)
+			if err == stores.ErrNoItem {
+				err = nil // a missing tile is loaded below and reported
+			} else if err != nil && err != ErrTimeout {
+				return
+			}
+
+			if file != nil {
+				defer file.Close()
+				if info, err = file.Stat(); err != nil {
+					return
+				}
+				if info.Size() == 0 {
+					encoding = "identity"
+				}
+
+				if bypass && options.Negative != nil {
+					options.Negative.Remove(key)
+				}
+				source(tileSource(store, &t))
+				tileHeaders(w, r, tileset, &t, encoding, &options)
+				if options.Sizes != nil && r.Method != "HEAD" {
+					options.Sizes.Record(t.Z, int(info.Size()))
+				}
+				// Ranges covering the whole tile are ignored so that the
+				// response matches that of tiles loaded into memory.
+				if wholeRange(r.Header.Get("Range"), info.Size()) {
+					r = r.Clone(r.Context())
+					r.Header.Del("Range")
+				}
+				http.ServeContent(&contentLengthWriter{w, info.Size()}, r, "", info.ModTime(), file)
+				return
+			}
+		}
+
+		if !covered && options.blankPolicy(tileset) == BLANK_NEVER {
+			missing()
+			return
+		}
+
+		incomplete := false // is a blank tile standing in for a tile that timed out?
+
+		// Load the tile, unless opening its file has already timed out.
+		if covered && err != ErrTimeout {
+			elapsed, err = options.load(w, r, store, tileset, &t)
+		}
+
+		if !covered {
+			// the tile is known to be outside the tileset's coverage
+			if err = blankTile(&t); err != nil {
+				return
+			}
+			source("blank")
+		} else if err == stores.ErrNoItem {
+			// the tile could not be found in the store
+			if store.TilesetStatus(tileset) == stores.NOT_FOUND {
 				err = nil
+				source("miss")
 				http.Error(w,
-					fmt.Errorf("The tileset `%s` does not exist", vars["tileset"]).Error(),
+					fmt.Errorf("The tileset `%s` does not exist", tileset).Error(),
 					http.StatusNotFound)
 				return
 			}
 
-			if t.IsRoot() {
-				// serve up a blank tile as it is a missing root tile
-				data, err := assets.Asset("data/smallterrain-blank.terrain")
-				if err != nil {
+			if options.blank(tileset, &t) {
+				// serve up a blank tile e.g. as it is a missing root tile
+				if err = blankTile(&t); err != nil {
 					return
-				} else {
-					err = t.UnmarshalBinary(data)
-					if err != nil {
-						return
-					}
 				}
+				source("blank")
 			} else {
 				err = nil
-				http.Error(w, errors.New("The terrain tile does not exist").Error(), http.StatusNotFound)
+				if options.Negative != nil {
+					options.Negative.Add(key)
+				}
+				missing()
 				return
 			}
+		} else if err == ErrTimeout && options.TimeoutResponse == TIMEOUT_UNAVAILABLE {
+			err = nil
+			source("timeout")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, ErrTimeout.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err == ErrTimeout && options.TimeoutResponse == TIMEOUT_BLANK {
+			// Trade completeness for latency: the tile may not really be
+			// blank so it mustn't be cached.
+			if err = blankTile(&t); err != nil {
+				return
+			}
+			incomplete = true
+			source("timeout")
 		} else if err != nil {
 			return
+		} else {
+			if bypass && options.Negative != nil {
+				options.Negative.Remove(key) // the tile has since been added
+			}
+			if t.Stale {
+				w.Header().Set("Warning", `110 - "Response is Stale"`)
+			}
+			source(tileSource(store, &t))
 		}
 
 		body, err := t.MarshalBinary()
@@ -68,11 +714,123 @@ func TerrainHandler(store stores.Storer) func(http.ResponseWriter, *http.Request
 			return
 		}
 
+		// Determine how the tile is encoded, preferring what the store
+		// reports, then the tileset configuration and finally the content.
+		if t.Encoding == "" {
+			t.Encoding = options.Tilesets.Get(tileset).Encoding
+		}
+		if t.Encoding == "" {
+			t.Encoding = sniffEncoding(body)
+		}
+		encoding := t.Encoding
+		modified := false // has the body changed from the stored tile?
+
+		// An empty body has no encoding: strict clients reject an empty body
+		// declared as gzip.
+		if len(body) == 0 {
+			encoding = "identity"
+		}
+
+		// Don't send corrupt or truncated tiles: a 502 lets the client retry
+		// instead of rendering garbage.
+		if options.StrictGzip && encoding == "gzip" {
+			if gzerr := VerifyGzip(body); gzerr != nil {
+				log.Err(fmt.Sprintf("corrupt tile %s/%d/%d/%d: %s", tileset, t.Z, t.X, t.Y, gzerr))
+				http.Error(w, errors.New("The terrain tile is corrupt").Error(), http.StatusBadGateway)
+				return
+			}
+		}
+
+		// Some clients only read the first member of multistream gzipped
+		// tiles, so these are recompressed as a single stream.
+		if options.NormalizeGzip && encoding == "gzip" {
+			var multistream bool
+			if multistream, err = MultistreamGzip(body); err != nil {
+				return
+			}
+			if multistream {
+				if body, err = NormalizeGzip(body, options.MaxDecompressed); err != nil {
+					return
+				}
+				modified = true
+			}
+		}
+
+		if pipeline := options.Tilesets.Get(tileset).Transforms; len(pipeline) > 0 {
+			if body, encoding, err = transform(pipeline, body, encoding, &options); err != nil {
+				return
+			}
+			modified = true
+		}
+
+		// Tiles stored with zstd, which is smaller than gzip, are passed
+		// through to clients which accept it and transcoded for others.
+		if encoding == "zstd" && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "zstd") {
+			if body, encoding, err = transcodeZstd(r, body, &options); err != nil {
+				return
+			}
+			modified = true
+		}
+
+		// Gzipped tiles are passed through to clients which accept gzip but
+		// decompressed for those that don't, rather than being mislabelled.
+		// Small tiles gain little from compression so can be sent as is.
+		acceptsGzip := acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip")
+		smallTile := options.GzipMinSize > 0 && Bytes(len(body)) < options.GzipMinSize && requiredEncoding(r) != "gzip"
+		if encoding == "gzip" && (!acceptsGzip || smallTile) {
+			if body, err = options.gunzip(body, &t, modified); err != nil {
+				return
+			}
+			encoding = "identity"
+			modified = true
+		}
+
+		// Clients requiring gzip get uncompressed tiles compressed.
+		if encoding == "identity" && requiredEncoding(r) == "gzip" {
+			if body, encoding, err = gzipTransform(body, encoding, &options); err != nil {
+				return
+			}
+			modified = true
+		}
+
+		// Clients holding the shared dictionary get tiles which would
+		// otherwise be compressed on the fly (or not at all) compressed
+		// with it.
+		if options.GzipDictionary != nil && (encoding == "identity" || (encoding == "gzip" && modified)) &&
+			acceptsEncoding(r.Header.Get("Accept-Encoding"), DICTIONARY_ENCODING) {
+			if encoding == "gzip" {
+				if body, err = Gunzip(body, options.MaxDecompressed); err != nil {
+					return
+				}
+			}
+			if body, err = DeflateDict(body, options.GzipDictionary); err != nil {
+				return
+			}
+			encoding = DICTIONARY_ENCODING
+			modified = true
+		}
+
+		var digest []byte
+		if options.ContentMD5 {
+			if !modified {
+				digest = t.MD5()
+			} else {
+				sum := md5.Sum(body)
+				digest = sum[:]
+			}
+		}
+
 		// send the tile to the client
-		headers := w.Header()
-		headers.Set("Content-Type", "application/octet-stream")
-		headers.Set("Content-Encoding", "gzip")
-		headers.Set("Content-Disposition", "attachment;filename="+vars["y"]+".terrain")
-		w.Write(body)
+		headers := tileHeaders(w, r, tileset, &t, encoding, &options)
+		if incomplete {
+			headers.Set("Cache-Control", "no-store")
+		}
+		if digest != nil {
+			headers.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest))
+		}
+		if options.Sizes != nil && r.Method != "HEAD" {
+			options.Sizes.Record(t.Z, len(body))
+		}
+		writeBody(w, r, http.StatusOK, body)
 	}
 }
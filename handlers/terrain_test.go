@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/geo-data/cesium-terrain-server/assets"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"github.com/geo-data/cesium-terrain-server/stores/fs"
+	"gopkg.in/rumicuna/mux.v2"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return a router serving tiles with handler as the server does.
+func tileRouter(handler func(http.ResponseWriter, *http.Request)) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/tilesets/{tileset:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.terrain", handler)
+	return r
+}
+
+// Write a tile to a tileset under a root directory.
+func writeTile(t *testing.T, root, tileset string, z, x, y uint64, tile []byte) {
+	dir := filepath.Join(root, tileset, strconv.FormatUint(z, 10), strconv.FormatUint(x, 10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, strconv.FormatUint(y, 10)+".terrain"), tile, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create a tileset directory containing a gzipped root tile, returning the
+// root directory and the tile.
+func tileDir(t *testing.T) (root string, tile []byte) {
+	root, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile = gzipData(t, bytes.Repeat([]byte{1, 2, 3, 4}, 2000))
+	writeTile(t, root, "test", 0, 0, 0, tile)
+	return
+}
+
+func TestTerrainHandlerRange(t *testing.T) {
+	root, tile := tileDir(t)
+	defer os.RemoveAll(root)
+
+	size := len(tile)
+	tests := []struct {
+		rng    string
+		status int
+		length int
+	}{
+		{"", http.StatusOK, size},
+		{"bytes=0-", http.StatusOK, size},
+		{" bytes=0- ", http.StatusOK, size},
+		{"bytes=0-99999", http.StatusOK, size},
+		{"bytes=0-9", http.StatusPartialContent, 10},
+		{"bytes=10-", http.StatusPartialContent, size - 10},
+		{"bytes=0-1,4-5", http.StatusPartialContent, -1},
+	}
+
+	for _, sendFiles := range []bool{false, true} {
+		router := tileRouter(TerrainHandler(fs.New(root), TerrainOptions{
+			SendFiles:       sendFiles,
+			MaxDecompressed: DefaultMaxDecompressed,
+		}))
+		for _, test := range tests {
+			if !sendFiles && test.status != http.StatusOK {
+				continue // only files are served with ranges
+			}
+
+			req := httptest.NewRequest("GET", "/tilesets/test/0/0/0.terrain", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			if test.rng != "" {
+				req.Header.Set("Range", test.rng)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Errorf("sendfile %v, range %q: got status %d, want %d", sendFiles, test.rng, rec.Code, test.status)
+				continue
+			}
+			if test.length >= 0 && rec.Body.Len() != test.length {
+				t.Errorf("sendfile %v, range %q: got %d bytes, want %d", sendFiles, test.rng, rec.Body.Len(), test.length)
+			}
+			if test.status == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), tile) {
+				t.Errorf("sendfile %v, range %q: body differs from the tile", sendFiles, test.rng)
+			}
+		}
+	}
+}
+
+func TestTerrainHandlerHead(t *testing.T) {
+	root, tile := tileDir(t)
+	defer os.RemoveAll(root)
+	writeTile(t, root, "sparse", 1, 0, 0, tile) // the root tile is missing
+
+	tests := []struct {
+		url            string
+		acceptEncoding string
+		status         int
+		blank          bool
+	}{
+		{"/tilesets/sparse/0/0/0.terrain", "gzip", http.StatusOK, true},
+		{"/tilesets/sparse/0/0/0.terrain", "", http.StatusOK, true},
+		{"/tilesets/sparse/0/1/0.terrain", "gzip", http.StatusOK, true},
+		{"/tilesets/sparse/1/0/0.terrain", "gzip", http.StatusOK, false},
+		{"/tilesets/sparse/1/1/0.terrain", "gzip", http.StatusNotFound, false},
+		{"/tilesets/missing/0/0/0.terrain", "gzip", http.StatusNotFound, false},
+	}
+
+	for _, sendFiles := range []bool{false, true} {
+		router := tileRouter(TerrainHandler(fs.New(root), TerrainOptions{
+			SendFiles:       sendFiles,
+			MaxDecompressed: DefaultMaxDecompressed,
+		}))
+
+		for _, test := range tests {
+			var recs [2]*httptest.ResponseRecorder
+			for i, method := range []string{"GET", "HEAD"} {
+				req := httptest.NewRequest(method, test.url, nil)
+				if test.acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", test.acceptEncoding)
+				}
+				recs[i] = httptest.NewRecorder()
+				router.ServeHTTP(recs[i], req)
+			}
+			get, head := recs[0], recs[1]
+
+			if get.Code != test.status || head.Code != test.status {
+				t.Errorf("%s: got GET status %d and HEAD status %d, want %d", test.url, get.Code, head.Code, test.status)
+			}
+			if !reflect.DeepEqual(get.Header(), head.Header()) {
+				t.Errorf("%s: GET headers %v differ from HEAD headers %v", test.url, get.Header(), head.Header())
+			}
+			if test.status != http.StatusOK {
+				continue // the server discards error bodies sent to HEAD requests
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("%s: HEAD returned a %d byte body", test.url, head.Body.Len())
+			}
+			if length := head.Header().Get("Content-Length"); test.blank && length != strconv.Itoa(get.Body.Len()) {
+				t.Errorf("%s: got Content-Length %s for a %d byte blank tile", test.url, length, get.Body.Len())
+			}
+		}
+	}
+}
+
+func TestBlankTileEncoding(t *testing.T) {
+	root, _ := tileDir(t)
+	defer os.RemoveAll(root)
+	router := tileRouter(TerrainHandler(fs.New(root), TerrainOptions{MaxDecompressed: DefaultMaxDecompressed}))
+
+	blank, err := assets.Asset("data/smallterrain-blank.terrain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inflated, err := Gunzip(blank, DefaultMaxDecompressed)
+	if err != nil {
+		t.Fatalf("the blank tile asset isn't gzipped: %s", err)
+	}
+
+	for _, acceptEncoding := range []string{"gzip", "gzip, deflate", ""} {
+		req := httptest.NewRequest("GET", "/tilesets/test/0/1/0.terrain", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		body := rec.Body.Bytes()
+		switch encoding := rec.Header().Get("Content-Encoding"); encoding {
+		case "gzip":
+			if body, err = Gunzip(body, DefaultMaxDecompressed); err != nil {
+				t.Errorf("Accept-Encoding %q: the body doesn't match Content-Encoding gzip: %s", acceptEncoding, err)
+				continue
+			}
+		case "":
+			if acceptEncoding != "" {
+				t.Errorf("Accept-Encoding %q: the blank tile isn't gzipped", acceptEncoding)
+			}
+		default:
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q", acceptEncoding, encoding)
+			continue
+		}
+		if !bytes.Equal(body, inflated) {
+			t.Errorf("Accept-Encoding %q: got a %d byte tile, want the %d byte blank tile", acceptEncoding, len(body), len(inflated))
+		}
+	}
+}
+
+func TestTerrainHandlerHTTP10(t *testing.T) {
+	root, _ := tileDir(t)
+	defer os.RemoveAll(root)
+
+	// The server buffers small responses so that it can set their
+	// Content-Length itself: the tile must be larger.
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	tile := gzipData(t, data)
+	writeTile(t, root, "large", 0, 0, 0, tile)
+
+	tests := []struct {
+		sendFiles bool
+		keepAlive bool
+	}{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(tileRouter(TerrainHandler(fs.New(root), TerrainOptions{
+			SendFiles:       test.sendFiles,
+			MaxDecompressed: DefaultMaxDecompressed,
+		})))
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+
+		// Request the tile twice on a kept alive connection.
+		requests := 1
+		if test.keepAlive {
+			requests = 2
+		}
+		for i := 0; i < requests; i++ {
+			request := "GET /tilesets/large/0/0/0.terrain HTTP/1.0\r\nAccept-Encoding: gzip\r\n"
+			if test.keepAlive {
+				request += "Connection: keep-alive\r\n"
+			}
+			if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("sendfile %v, keep-alive %v: %s", test.sendFiles, test.keepAlive, err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != http.StatusOK || res.Proto != "HTTP/1.0" {
+				t.Errorf("sendfile %v, keep-alive %v: got %s %s", test.sendFiles, test.keepAlive, res.Proto, res.Status)
+			}
+			if len(res.TransferEncoding) > 0 || res.ContentLength != int64(len(tile)) {
+				t.Errorf("sendfile %v, keep-alive %v: got Transfer-Encoding %v and Content-Length %d", test.sendFiles, test.keepAlive, res.TransferEncoding, res.ContentLength)
+			}
+			if !bytes.Equal(body, tile) {
+				t.Errorf("sendfile %v, keep-alive %v: body differs from the tile", test.sendFiles, test.keepAlive)
+			}
+			if connection := res.Header.Get("Connection"); (connection == "close") == test.keepAlive {
+				t.Errorf("sendfile %v, keep-alive %v: got Connection %q", test.sendFiles, test.keepAlive, connection)
+			}
+		}
+
+		// A connection which isn't kept alive is closed after the response.
+		if !test.keepAlive {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err = reader.ReadByte(); err != io.EOF {
+				t.Errorf("sendfile %v: the connection wasn't closed: %v", test.sendFiles, err)
+			}
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	base, _ := tileDir(t)
+	defer os.RemoveAll(base)
+	top, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(top)
+	writeTile(t, top, "test", 1, 0, 0, gzipData(t, []byte("top")))
+
+	tests := []struct {
+		store   stores.Storer
+		url     string
+		metrics []string
+	}{
+		{fs.New(base), "/tilesets/test/0/0/0.terrain", []string{"fs"}},
+		{stores.NewOverlay(fs.New(top), fs.New(base)), "/tilesets/test/1/0/0.terrain", []string{"fs-0"}},
+		{stores.NewOverlay(fs.New(top), fs.New(base)), "/tilesets/test/0/0/0.terrain", []string{"fs-0", "fs-1"}},
+		{stores.NewOverlay(fs.New(top), fs.New(base)), "/tilesets/test/0/0/1.terrain", []string{"fs-0", "fs-1"}},
+	}
+
+	for _, test := range tests {
+		router := tileRouter(TerrainHandler(test.store, TerrainOptions{
+			ServerTiming:    true,
+			MaxDecompressed: DefaultMaxDecompressed,
+		}))
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var metrics []string
+		for _, value := range rec.Header()["Server-Timing"] {
+			parts := strings.Split(value, ";dur=")
+			if _, err := strconv.ParseFloat(parts[len(parts)-1], 64); len(parts) != 2 || err != nil {
+				t.Errorf("%s: bad Server-Timing %q", test.url, value)
+				continue
+			}
+			metrics = append(metrics, parts[0])
+		}
+		if !reflect.DeepEqual(metrics, test.metrics) {
+			t.Errorf("%s: got metrics %v, want %v", test.url, metrics, test.metrics)
+		}
+	}
+}
+
+func TestTimingName(t *testing.T) {
+	tests := map[string]string{
+		"fs":             "fs",
+		"fs[1]":          "fs-1",
+		"overlay(fs,fs)": "overlay-fs-fs",
+		"*fs.Store":      "fs.Store",
+		"s3 tiles":       "s3-tiles",
+		"[]":             "store",
+	}
+	for store, name := range tests {
+		if got := timingName(store); got != name {
+			t.Errorf("timingName(%q): got %q, want %q", store, got, name)
+		}
+	}
+}
+
+func TestTilesetFormat(t *testing.T) {
+	root, tile := tileDir(t)
+	defer os.RemoveAll(root)
+	writeTile(t, root, "mesh", 0, 0, 0, tile)
+
+	const (
+		heightmap = stores.HEIGHTMAP_MEDIA_TYPE
+		mesh      = stores.QUANTIZED_MESH_MEDIA_TYPE
+	)
+	tests := []struct {
+		url         string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"/tilesets/test/0/0/0.terrain", "", http.StatusOK, heightmap},
+		{"/tilesets/test/0/0/0.terrain", "*/*", http.StatusOK, heightmap},
+		{"/tilesets/test/0/0/0.terrain", mesh, http.StatusOK, heightmap},
+		{"/tilesets/mesh/0/0/0.terrain", "", http.StatusOK, mesh},
+		{"/tilesets/mesh/0/0/0.terrain", mesh + ",*/*;q=0.01", http.StatusOK, mesh},
+		{"/tilesets/mesh/0/0/0.terrain", heightmap, http.StatusOK, mesh},
+		{"/tilesets/test/0/0/0.qmesh", "", http.StatusNotFound, ""},
+		{"/tilesets/mesh/0/0/0.qmesh", "", http.StatusOK, mesh},
+		{"/tilesets/mesh/0/0/0.qmesh", heightmap, http.StatusOK, mesh},
+	}
+
+	config := Tilesets{"mesh": &Tileset{Format: stores.QUANTIZED_MESH_FORMAT}}
+	handler := TerrainHandler(fs.New(root), TerrainOptions{
+		Tilesets:        config,
+		MaxDecompressed: DefaultMaxDecompressed,
+	})
+	router := tileRouter(handler)
+	router.HandleFunc("/tilesets/{tileset:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.qmesh", TileFormat(mesh, handler))
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s, Accept %q: got status %d, want %d", test.url, test.accept, rec.Code, test.status)
+		} else if contentType := rec.Header().Get("Content-Type"); test.status == http.StatusOK && contentType != test.contentType {
+			t.Errorf("%s, Accept %q: got Content-Type %s, want %s", test.url, test.accept, contentType, test.contentType)
+		} else if test.status == http.StatusOK {
+			// Tiles are downloaded with the extension of their format.
+			filename := "attachment;filename=0" + tileExtension(test.contentType)
+			if disposition := rec.Header().Get("Content-Disposition"); disposition != filename {
+				t.Errorf("%s, Accept %q: got Content-Disposition %s, want %s", test.url, test.accept, disposition, filename)
+			}
+		}
+	}
+}
+
+func TestStrictAccept(t *testing.T) {
+	root, tile := tileDir(t)
+	defer os.RemoveAll(root)
+	writeTile(t, root, "mesh", 0, 0, 0, tile)
+
+	const (
+		heightmap = stores.HEIGHTMAP_MEDIA_TYPE
+		mesh      = stores.QUANTIZED_MESH_MEDIA_TYPE
+	)
+	tests := []struct {
+		url    string
+		accept string
+		status int
+	}{
+		{"/tilesets/test/0/0/0.terrain", heightmap, http.StatusOK},
+		{"/tilesets/test/0/0/0.terrain", mesh, http.StatusNotAcceptable},
+		{"/tilesets/mesh/0/0/0.terrain", "", http.StatusOK},
+		{"/tilesets/mesh/0/0/0.terrain", "*/*", http.StatusOK},
+		{"/tilesets/mesh/0/0/0.terrain", mesh, http.StatusOK},
+		{"/tilesets/mesh/0/0/0.terrain", heightmap, http.StatusNotAcceptable},
+	}
+
+	router := tileRouter(TerrainHandler(fs.New(root), TerrainOptions{
+		StrictAccept:    true,
+		Tilesets:        Tilesets{"mesh": &Tileset{Format: stores.QUANTIZED_MESH_FORMAT}},
+		MaxDecompressed: DefaultMaxDecompressed,
+	}))
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s, Accept %q: got status %d, want %d", test.url, test.accept, rec.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"gopkg.in/rumicuna/mux.v2"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The maximum number of resolved tileset names remembered by
+// CaseInsensitiveTilesets.
+const MAX_RESOLVED_NAMES = 10000
+
+type tilesetKey struct{}
+
+// TilesetName returns the name of the tileset being requested. This is the
+// `tileset` route variable unless the handler has been wrapped by
+// FixedTileset.
+func TilesetName(r *http.Request) string {
+	if name, ok := r.Context().Value(tilesetKey{}).(string); ok {
+		return name
+	}
+	return mux.Vars(r)["tileset"]
+}
+
+// FixedTileset wraps a handler so that it always serves the named tileset,
+// allowing it to be routed without a `tileset` route variable.
+func FixedTileset(name string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), tilesetKey{}, name)))
+	}
+}
+
+// Aliases maps public tileset names to the names of the tilesets in the store,
+// e.g. `world` to `world-2024`.
+type Aliases map[string]string
+
+// Resolve returns the name of the tileset in the store for a requested name.
+// Names without an alias are returned unchanged.
+func (this Aliases) Resolve(name string) string {
+	if target, ok := this[name]; ok {
+		return target
+	}
+	return name
+}
+
+// AliasTilesets wraps a handler so that it serves the tileset aliased by the
+// requested tileset name.
+func AliasTilesets(aliases Aliases, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if len(aliases) == 0 {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := aliases.Resolve(TilesetName(r))
+		handler(w, r.WithContext(context.WithValue(r.Context(), tilesetKey{}, name)))
+	}
+}
+
+type versionKey struct{}
+
+// A tileset version requested with VersionedTilesets.
+type tilesetVersion struct {
+	param, version string
+}
+
+// Versions are restricted to names which are safe as a path segment.
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z_.-]+$`)
+
+// VersionedTilesets wraps a handler so that requests giving a version in the
+// param query parameter e.g. `?version=3` are served from the version's
+// directory within the tileset e.g. `srtm/v3`. Requests without a version are
+// served from the tileset itself.
+func VersionedTilesets(param string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := r.URL.Query().Get(param)
+		if version == "" {
+			handler(w, r)
+			return
+		}
+
+		if !versionPattern.MatchString(version) {
+			http.Error(w, fmt.Sprintf("The tileset version `%s` is invalid", version), http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tilesetKey{}, TilesetName(r)+"/v"+version)
+		ctx = context.WithValue(ctx, versionKey{}, tilesetVersion{param, version})
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// Add the version requested with VersionedTilesets (if any) to the tile url
+// templates in a `layer.json` file, so that the tiles are requested from the
+// same version.
+func versionLayer(r *http.Request, layer []byte) ([]byte, error) {
+	v, ok := r.Context().Value(versionKey{}).(tilesetVersion)
+	if !ok {
+		return layer, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(layer, &fields); err != nil {
+		return nil, err
+	}
+
+	var templates []string
+	if _, ok := fields["tiles"]; !ok {
+		return layer, nil
+	} else if err := json.Unmarshal(fields["tiles"], &templates); err != nil {
+		return nil, err
+	}
+	for i, template := range templates {
+		separator := "?"
+		if strings.Contains(template, "?") {
+			separator = "&"
+		}
+		templates[i] = template + separator + url.QueryEscape(v.param) + "=" + url.QueryEscape(v.version)
+	}
+
+	tiles, err := json.Marshal(templates)
+	if err != nil {
+		return nil, err
+	}
+	fields["tiles"] = tiles
+	return json.MarshalIndent(fields, "", "  ")
+}
+
+// CaseInsensitiveTilesets wraps a handler so that requests for a tileset which
+// doesn't exist are served by a tileset whose name differs only in case, if
+// the store can find one. Up to MAX_RESOLVED_NAMES resolved names are
+// remembered.
+func CaseInsensitiveTilesets(store stores.Storer, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	nr, ok := store.(stores.NameResolver)
+	if !ok {
+		return handler
+	}
+
+	var lock sync.RWMutex
+	resolved := make(map[string]string)
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := TilesetName(r)
+
+		lock.RLock()
+		target, ok := resolved[name]
+		lock.RUnlock()
+
+		if !ok {
+			if store.TilesetStatus(name) == stores.NOT_FOUND {
+				var err error
+				if target, err = nr.ResolveName(name); err != nil {
+					handler(w, r) // let the handler report the missing tileset
+					return
+				}
+
+				lock.Lock()
+				if len(resolved) < MAX_RESOLVED_NAMES {
+					resolved[name] = target
+				}
+				lock.Unlock()
+			} else {
+				target = name
+			}
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), tilesetKey{}, target)))
+	}
+}
+
+// StripTrailingSlash is HTTP middleware which removes trailing slashes from
+// request paths, so that e.g. `/tilesets/srtm/layer.json/` is routed as
+// `/tilesets/srtm/layer.json`.
+func StripTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path := strings.TrimRight(r.URL.Path, "/"); path != r.URL.Path && path != "" {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Tileset holds configuration specific to a tileset.
+type Tileset struct {
+	// Headers added to responses for the tileset's tiles, overriding the
+	// defaults e.g. `Cache-Control: max-age=86400`.
+	Headers map[string]string `json:"headers"`
+	// How tiles are encoded in the store: `gzip`, `zstd` or `identity`. If
+	// not set the encoding is detected from the content of each tile.
+	Encoding string `json:"encoding"`
+	// The tile format e.g. `quantized-mesh-1.0`, which determines the media
+	// type tiles are negotiated and sent as, and selects the default
+	// `layer.json` if the tileset doesn't provide one.
+	Format string `json:"format"`
+	// Named transforms applied in order to each tile before it is sent e.g.
+	// `["gunzip", "strip-extensions", "gzip"]`.
+	Transforms []string `json:"transforms"`
+	// When missing tiles are served as blank tiles: one of the BLANK_
+	// policies, overriding the server's default.
+	Blank string `json:"blank"`
+	// If set the tileset is restricted to clients presenting one of these
+	// keys. Otherwise it is public.
+	Keys []string `json:"keys"`
+	// The attribution set in the tileset's `layer.json`, overriding the
+	// server's default.
+	Attribution string `json:"attribution"`
+}
+
+// MediaType returns the media type of the tileset's tiles according to its
+// format. Tilesets without a known format contain heightmaps.
+func (this *Tileset) MediaType() string {
+	if this.Format == stores.QUANTIZED_MESH_FORMAT {
+		return stores.QUANTIZED_MESH_MEDIA_TYPE
+	}
+	return stores.HEIGHTMAP_MEDIA_TYPE
+}
+
+// Policies for serving missing tiles as blank tiles.
+const (
+	BLANK_ROOT   = "root"   // only missing root tiles are blank
+	BLANK_ALWAYS = "always" // all missing tiles are blank
+	BLANK_NEVER  = "never"  // no tiles are blank, not even outside coverage masks
+)
+
+// ValidateBlank checks a blank tile policy.
+func ValidateBlank(policy string) error {
+	switch policy {
+	case BLANK_ROOT, BLANK_ALWAYS, BLANK_NEVER:
+		return nil
+	}
+	return fmt.Errorf("bad blank tile policy %s: choose one of root, always, never", policy)
+}
+
+// Tilesets maps tileset names to their configuration.
+type Tilesets map[string]*Tileset
+
+// Get returns the configuration for a tileset, which is empty if the tileset
+// is not configured.
+func (this Tilesets) Get(name string) *Tileset {
+	if tileset, ok := this[name]; ok && tileset != nil {
+		return tileset
+	}
+	return &Tileset{}
+}
+
+// Restrictions returns the keys of each tileset restricting access to the
+// named tileset: the tileset itself and the tilesets containing it e.g. `world`
+// for `world/europe/v3`. A client must present a key for each of them.
+func (this Tilesets) Restrictions(name string) (restrictions [][]string) {
+	var ancestor string
+	for _, segment := range strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/") {
+		if ancestor == "" {
+			ancestor = segment
+		} else {
+			ancestor += "/" + segment
+		}
+		if keys := this.Get(ancestor).Keys; len(keys) > 0 {
+			restrictions = append(restrictions, keys)
+		}
+	}
+	return
+}
+
+// Restricted returns whether a tileset is restricted to clients presenting a
+// key.
+func (this Tilesets) Restricted(name string) bool {
+	return len(this.Restrictions(name)) > 0
+}
+
+// Validate checks the configuration of each tileset.
+func (this Tilesets) Validate() error {
+	for name, tileset := range this {
+		if tileset == nil {
+			continue
+		}
+
+		switch tileset.Encoding {
+		case "", "gzip", "zstd", "identity":
+		default:
+			return fmt.Errorf("tileset %s: bad encoding %s: choose one of gzip, zstd, identity", name, tileset.Encoding)
+		}
+
+		if err := validatePipeline(tileset.Transforms); err != nil {
+			return fmt.Errorf("tileset %s: %s", name, err)
+		}
+
+		if tileset.Blank != "" {
+			if err := ValidateBlank(tileset.Blank); err != nil {
+				return fmt.Errorf("tileset %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Transform modifies the body of a tile before it is sent to the client. It
+// is passed the tile's body and content encoding and returns the new body and
+// encoding.
+type Transform func(body []byte, encoding string, options *TerrainOptions) ([]byte, string, error)
+
+// The transforms available to tileset transform pipelines, by name.
+var transforms = map[string]Transform{
+	"gunzip":           gunzipTransform,
+	"gzip":             gzipTransform,
+	"strip-extensions": stripExtensionsTransform,
+}
+
+// Return the names of the transforms.
+func transformNames() (names []string) {
+	for name := range transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Apply a pipeline of named transforms to a tile body in order.
+func transform(pipeline []string, body []byte, encoding string, options *TerrainOptions) ([]byte, string, error) {
+	var err error
+	for _, name := range pipeline {
+		fn, ok := transforms[name]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown transform %s", name)
+		}
+
+		if body, encoding, err = fn(body, encoding, options); err != nil {
+			return nil, "", fmt.Errorf("transform %s: %s", name, err)
+		}
+	}
+	return body, encoding, nil
+}
+
+// Decompress gzipped tiles.
+func gunzipTransform(body []byte, encoding string, options *TerrainOptions) ([]byte, string, error) {
+	if encoding != "gzip" {
+		return body, encoding, nil
+	}
+
+	body, err := Gunzip(body, options.MaxDecompressed)
+	return body, "identity", err
+}
+
+// Compress tiles which aren't already encoded.
+func gzipTransform(body []byte, encoding string, options *TerrainOptions) ([]byte, string, error) {
+	if encoding != "identity" {
+		return body, encoding, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "gzip", nil
+}
+
+// Remove the extensions (e.g. vertex normals and water masks) which follow the
+// mesh data in a quantized-mesh tile.
+func stripExtensionsTransform(body []byte, encoding string, options *TerrainOptions) ([]byte, string, error) {
+	if encoding != "identity" {
+		return nil, "", errors.New("tiles must be decompressed first")
+	}
+
+	size, err := quantizedMeshSize(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body[:size], encoding, nil
+}
+
+var errTruncatedMesh = errors.New("truncated quantized-mesh tile")
+
+// Return the size of the mesh data in a quantized-mesh tile, excluding any
+// extensions.
+func quantizedMeshSize(body []byte) (int, error) {
+	// Read a count at an offset, advancing the offset.
+	var offset int
+	count := func() (int, error) {
+		if offset+4 > len(body) {
+			return 0, errTruncatedMesh
+		}
+		n := int(binary.LittleEndian.Uint32(body[offset:]))
+		offset += 4
+		return n, nil
+	}
+
+	offset = 88 // the header
+	vertices, err := count()
+	if err != nil {
+		return 0, err
+	}
+	offset += vertices * 3 * 2 // u, v and height arrays
+
+	// Large meshes use 32 bit indices, aligned on a 4 byte boundary.
+	indexSize := 2
+	if vertices > 65536 {
+		indexSize = 4
+	}
+	if rem := offset % indexSize; rem != 0 {
+		offset += indexSize - rem
+	}
+
+	triangles, err := count()
+	if err != nil {
+		return 0, err
+	}
+	offset += triangles * 3 * indexSize
+
+	// The west, south, east and north edge indices
+	for i := 0; i < 4; i++ {
+		n, err := count()
+		if err != nil {
+			return 0, err
+		}
+		offset += n * indexSize
+	}
+
+	if offset > len(body) {
+		return 0, errTruncatedMesh
+	}
+	return offset, nil
+}
+
+// Check that a pipeline only names registered transforms.
+func validatePipeline(pipeline []string) error {
+	for _, name := range pipeline {
+		if _, ok := transforms[name]; !ok {
+			return fmt.Errorf("unknown transform %s: choose from %s", name, strings.Join(transformNames(), ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Unzstd decompresses zstd encoded data, returning ErrDecompressedTooLarge if
+// it inflates beyond limit bytes as with Gunzip.
+func Unzstd(data []byte, limit Bytes) (body []byte, err error) {
+	reader, err := zstd.NewReader(bytes.NewReader(data),
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	// Read one byte beyond the limit so that overflow can be detected.
+	body, err = ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		body = nil
+		return
+	}
+
+	if Bytes(len(body)) > limit {
+		body = nil
+		err = ErrDecompressedTooLarge
+	}
+	return
+}
+
+// Transcode a zstd compressed tile for a client which doesn't accept zstd. The
+// tile is gzipped for clients accepting gzip, unless it is smaller than
+// GzipMinSize, and is otherwise sent uncompressed.
+func transcodeZstd(r *http.Request, body []byte, options *TerrainOptions) ([]byte, string, error) {
+	body, err := Unzstd(body, options.MaxDecompressed)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") ||
+		(options.GzipMinSize > 0 && Bytes(len(body)) < options.GzipMinSize) {
+		return body, "identity", nil
+	}
+	return gzipTransform(body, "identity", options)
+}
@@ -82,3 +82,46 @@ func SetLogger(logger Logger) {
 func SetLog(log *l.Logger, priority Priority) {
 	SetLogger(New(log, priority))
 }
+
+type filter struct {
+	priority Priority
+	logger   Logger
+}
+
+// Filter returns a Logger which discards messages below priority before
+// passing them on to logger. This is useful for loggers such as syslog.Writer
+// which do not filter messages themselves.
+func Filter(logger Logger, priority Priority) Logger {
+	return &filter{
+		priority: priority,
+		logger:   logger,
+	}
+}
+
+func (this *filter) Debug(m string) (err error) {
+	if this.priority <= LOG_DEBUG {
+		err = this.logger.Debug(m)
+	}
+	return
+}
+
+func (this *filter) Notice(m string) (err error) {
+	if this.priority <= LOG_NOTICE {
+		err = this.logger.Notice(m)
+	}
+	return
+}
+
+func (this *filter) Err(m string) (err error) {
+	if this.priority <= LOG_ERR {
+		err = this.logger.Err(m)
+	}
+	return
+}
+
+func (this *filter) Crit(m string) (err error) {
+	if this.priority <= LOG_CRIT {
+		err = this.logger.Crit(m)
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package stores
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BalanceStrategy determines how a Balancer chooses between its stores.
+type BalanceStrategy int
+
+const (
+	ROUND_ROBIN BalanceStrategy = iota // use each store in turn
+	FASTEST                            // prefer the store with the lowest recent latency
+)
+
+// How often the FASTEST strategy uses the next store in turn instead of the
+// fastest, so that the latencies of the other stores stay current.
+const PROBE_INTERVAL = 20
+
+// The latency recorded for failed requests by the FASTEST strategy, unless they
+// took longer, so that stores which fail quickly aren't preferred.
+const FAILURE_LATENCY = time.Second
+
+// Balancer is a store composed of equivalent stores, such as replicas of the
+// same tilesets, which spreads requests between them. If a store fails with
+// an error other than ErrNoItem the request is retried with the other stores.
+type Balancer struct {
+	stores    []Storer
+	strategy  BalanceStrategy
+	next      uint64  // a counter used to select stores in turn
+	latencies []int64 // the moving average latency of each store in nanoseconds
+	health    *healthMonitor
+}
+
+func NewBalancer(strategy BalanceStrategy, stores ...Storer) *Balancer {
+	return &Balancer{
+		stores:    stores,
+		strategy:  strategy,
+		latencies: make([]int64, len(stores)),
+	}
+}
+
+// Stores returns the balanced stores.
+func (this *Balancer) Stores() []Storer {
+	return this.stores
+}
+
+// Monitor checks the health of the stores at an interval. Unhealthy stores are
+// skipped until they recover unless all the stores are unhealthy.
+func (this *Balancer) Monitor(interval time.Duration) {
+	this.health = monitorHealth(this.stores, interval)
+}
+
+// Describe implements the Describer interface, reporting any stores which are
+// being skipped.
+func (this *Balancer) Describe() Description {
+	return this.health.describe("balancer", this.stores)
+}
+
+func (this *Balancer) String() string {
+	names := make([]string, len(this.stores))
+	for i, store := range this.stores {
+		names[i] = storeName(store)
+	}
+	return "balancer(" + strings.Join(names, ",") + ")"
+}
+
+// Return the index of the store to try first.
+func (this *Balancer) first() int {
+	n := atomic.AddUint64(&this.next, 1) - 1
+	if this.strategy != FASTEST || n%PROBE_INTERVAL == 0 {
+		return int(n % uint64(len(this.stores)))
+	}
+
+	best := 0
+	for i := range this.latencies {
+		if atomic.LoadInt64(&this.latencies[i]) < atomic.LoadInt64(&this.latencies[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Record the latency of a store, weighting recent requests most heavily.
+func (this *Balancer) record(i int, latency time.Duration) {
+	for {
+		old := atomic.LoadInt64(&this.latencies[i])
+		avg := int64(latency)
+		if old > 0 {
+			avg = old + (int64(latency)-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&this.latencies[i], old, avg) {
+			return
+		}
+	}
+}
+
+// Call fn with each store in turn, starting with the chosen store, until it
+// succeeds or returns ErrNoItem.
+func (this *Balancer) try(fn func(store Storer) error) (err error) {
+	if len(this.stores) == 0 {
+		return ErrNoItem
+	}
+
+	// Skip unhealthy stores, unless none are healthy.
+	healthy := 0
+	for i := range this.stores {
+		if this.health.ok(i) {
+			healthy++
+		}
+	}
+
+	first := this.first()
+	for i := range this.stores {
+		j := (first + i) % len(this.stores)
+		if healthy > 0 && !this.health.ok(j) {
+			continue
+		}
+
+		start := time.Now()
+		err = fn(this.stores[j])
+		if this.strategy == FASTEST {
+			latency := time.Since(start)
+			if err != nil && err != ErrNoItem && latency < FAILURE_LATENCY {
+				latency = FAILURE_LATENCY
+			}
+			this.record(j, latency)
+		}
+
+		if err == nil || err == ErrNoItem {
+			return
+		}
+	}
+	return
+}
+
+func (this *Balancer) Tile(tileset string, tile *Terrain) error {
+	return this.try(func(store Storer) error {
+		err := store.Tile(tileset, tile)
+		if err == nil {
+			for i := range this.stores {
+				if this.stores[i] == store {
+					setSource(tile, this.stores, i)
+					break
+				}
+			}
+		}
+		return err
+	})
+}
+
+func (this *Balancer) Layer(tileset string) (layer []byte, err error) {
+	err = this.try(func(store Storer) (err error) {
+		layer, err = store.Layer(tileset)
+		return
+	})
+	return
+}
+
+// Tilesets implements the TilesetLister interface, listing the tilesets in any
+// of the stores.
+func (this *Balancer) Tilesets() ([]string, error) {
+	return listTilesets(this.stores)
+}
+
+// TilesetStatus returns the status reported by the first store, as the stores
+// are equivalent.
+func (this *Balancer) TilesetStatus(tileset string) TilesetStatus {
+	if len(this.stores) == 0 {
+		return NOT_FOUND
+	}
+	return this.stores[this.first()].TilesetStatus(tileset)
+}
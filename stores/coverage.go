@@ -0,0 +1,170 @@
+package stores
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Coverage is a low resolution bitmap describing which parts of the globe a
+// tileset covers. Each pixel corresponds to a tile at zoom level Zoom in the
+// geographic TMS tiling scheme, so the bitmap is twice as wide as it is high.
+type Coverage struct {
+	Zoom          uint64
+	width, height uint64
+	bits          []bool // row major, the first row being the northernmost
+}
+
+// CoverageStorer is implemented by stores which can supply a coverage mask for
+// a tileset. ErrNoItem is returned if the tileset has no mask.
+type CoverageStorer interface {
+	Storer
+	Coverage(tileset string) (*Coverage, error)
+}
+
+// ParseCoverage creates a Coverage from a Portable Bitmap (PBM) image in
+// either the plain (P1) or raw (P4) format. Set (black) pixels represent areas
+// containing data. The image must be 2^(z+1) pixels wide by 2^z pixels high
+// for a mask at zoom level z.
+func ParseCoverage(data []byte) (coverage *Coverage, err error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	var magic string
+	var width, height uint64
+	if err = pbmHeader(reader, &magic, &width, &height); err != nil {
+		return
+	}
+
+	zoom := uint64(0)
+	for (uint64(1) << zoom) < height {
+		zoom++
+	}
+	if height == 0 || (uint64(1)<<zoom) != height || width != height*2 {
+		err = fmt.Errorf("bad coverage dimensions %dx%d: the width must be twice the height which must be a power of two", width, height)
+		return
+	}
+
+	bits := make([]bool, width*height)
+	switch magic {
+	case "P1":
+		for i := range bits {
+			var bit int
+			if _, err = fmt.Fscan(reader, &bit); err != nil {
+				return
+			}
+			bits[i] = bit == 1
+		}
+	case "P4":
+		stride := (width + 7) / 8
+		row := make([]byte, stride)
+		for y := uint64(0); y < height; y++ {
+			if _, err = io.ReadFull(reader, row); err != nil {
+				return
+			}
+			for x := uint64(0); x < width; x++ {
+				bits[y*width+x] = row[x/8]&(0x80>>(x%8)) != 0
+			}
+		}
+	}
+
+	coverage = &Coverage{
+		Zoom:   zoom,
+		width:  width,
+		height: height,
+		bits:   bits,
+	}
+	return
+}
+
+// Read the magic number and dimensions from a PBM header, skipping comments.
+func pbmHeader(reader *bufio.Reader, magic *string, width, height *uint64) error {
+	var tokens []string
+	for len(tokens) < 3 {
+		var token string
+		if _, err := fmt.Fscan(reader, &token); err != nil {
+			return err
+		}
+
+		if token[0] == '#' {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return err
+			}
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+
+	*magic = tokens[0]
+	if *magic != "P1" && *magic != "P4" {
+		return errors.New("coverage must be a P1 or P4 PBM image")
+	}
+
+	if _, err := fmt.Sscan(tokens[1]+" "+tokens[2], width, height); err != nil {
+		return err
+	}
+
+	// A single whitespace character separates the header from raw data.
+	_, err := reader.ReadByte()
+	return err
+}
+
+// Covers returns true if the mask indicates that data may exist for the tile.
+// Tiles above the mask's zoom level are covered if any of the pixels they span
+// are set.
+func (this *Coverage) Covers(tile *Terrain) bool {
+	var x0, y0, size uint64
+	if tile.Z >= this.Zoom {
+		shift := tile.Z - this.Zoom
+		x0, y0, size = tile.X>>shift, tile.Y>>shift, 1
+	} else {
+		shift := this.Zoom - tile.Z
+		x0, y0, size = tile.X<<shift, tile.Y<<shift, uint64(1)<<shift
+	}
+
+	for y := y0; y < y0+size && y < this.height; y++ {
+		row := this.height - 1 - y // TMS rows count from the south
+		for x := x0; x < x0+size && x < this.width; x++ {
+			if this.bits[row*this.width+x] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UnionCoverage returns a mask covering the tiles covered by any of the masks,
+// at the highest zoom level of the masks.
+func UnionCoverage(masks ...*Coverage) *Coverage {
+	if len(masks) == 1 {
+		return masks[0]
+	}
+
+	zoom := uint64(0)
+	for _, mask := range masks {
+		if mask.Zoom > zoom {
+			zoom = mask.Zoom
+		}
+	}
+
+	union := &Coverage{
+		Zoom:   zoom,
+		width:  uint64(2) << zoom,
+		height: uint64(1) << zoom,
+	}
+	union.bits = make([]bool, union.width*union.height)
+	for y := uint64(0); y < union.height; y++ {
+		row := union.height - 1 - y // TMS rows count from the south
+		for x := uint64(0); x < union.width; x++ {
+			tile := Terrain{X: x, Y: y, Z: zoom}
+			for _, mask := range masks {
+				if mask.Covers(&tile) {
+					union.bits[row*union.width+x] = true
+					break
+				}
+			}
+		}
+	}
+	return union
+}
@@ -0,0 +1,410 @@
+// Package diskcache provides a store which caches the tiles of another store
+// (e.g. an object store) on local disk. Unlike a tileset directory the cache
+// is bounded: once it grows beyond its maximum size the least recently used
+// tiles are removed. Tiles are cached as `<dir>/<tileset>/<z>/<x>/<y>.terrain`
+// and the cache survives restarts, being reindexed on startup.
+package diskcache
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A cached tile.
+type entry struct {
+	path string
+	size int64
+}
+
+type Store struct {
+	hits, misses uint64 // updated atomically, so first for 64 bit alignment
+
+	dir     string
+	maxSize int64
+	origin  stores.Storer
+
+	lock  sync.Mutex
+	lru   *list.List               // entries, most recently used first
+	index map[string]*list.Element // entries by path
+	size  int64                    // the total size of the entries
+
+	health *stores.HealthCheck // nil unless health checks are enabled
+}
+
+// New returns a store caching the tiles of the origin store in dir, using at
+// most maxSize bytes. Tiles already in dir are indexed, the most recently
+// modified being treated as the most recently used.
+func New(dir string, maxSize int64, origin stores.Storer) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	this := &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		origin:  origin,
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+	}
+	if err := this.scan(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// Index the tiles already in the cache directory.
+func (this *Store) scan() error {
+	type cached struct {
+		entry
+		mtime int64
+	}
+	var found []cached
+	err := filepath.Walk(this.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && strings.Contains(info.Name(), ".terrain.tmp") {
+			os.Remove(path) // left by an interrupted write
+		} else if strings.HasSuffix(path, ".terrain") {
+			found = append(found, cached{entry{path, info.Size()}, info.ModTime().UnixNano()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].mtime > found[j].mtime })
+	for _, c := range found {
+		this.index[c.path] = this.lru.PushBack(&entry{c.path, c.size})
+		this.size += c.size
+	}
+	this.evict()
+	log.Debug(fmt.Sprintf("disk cache: indexed %d tiles (%d bytes) in %s", this.lru.Len(), this.size, this.dir))
+	return nil
+}
+
+// Overlaps returns true if one of two directories contains the other, as a
+// cache directory overlapping a tileset directory would evict its tiles.
+func Overlaps(dir, other string) bool {
+	a, err1 := filepath.Abs(dir)
+	b, err2 := filepath.Abs(other)
+	if err1 != nil || err2 != nil {
+		return true // be safe
+	}
+	return within(a, b) || within(b, a)
+}
+
+// Return true if the absolute path is the directory or within it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (this *Store) String() string {
+	return "diskcache"
+}
+
+// Origin returns the store whose tiles are cached.
+func (this *Store) Origin() stores.Storer {
+	return this.origin
+}
+
+// Return the path at which a tile is cached. Only the default representation
+// of tiles is cached, and tileset names with empty or relative segments are
+// rejected.
+func (this *Store) path(tileset string, tile *stores.Terrain) (path string, ok bool) {
+	if tile.MediaType != "" && tile.MediaType != stores.HEIGHTMAP_MEDIA_TYPE {
+		return
+	}
+	if len(tile.AcceptEncodings) > 0 {
+		return
+	}
+	for _, segment := range strings.Split(tileset, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return
+		}
+	}
+	return filepath.Join(this.dir, filepath.FromSlash(tileset),
+		strconv.FormatUint(tile.Z, 10), strconv.FormatUint(tile.X, 10),
+		strconv.FormatUint(tile.Y, 10)+".terrain"), true
+}
+
+// Remove the least recently used tiles until the cache is within its maximum
+// size. The lock must be held (or the store not yet shared).
+func (this *Store) evict() {
+	for this.size > this.maxSize && this.lru.Len() > 0 {
+		oldest := this.lru.Back()
+		e := oldest.Value.(*entry)
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			log.Err(fmt.Sprintf("disk cache: cannot evict %s: %s", e.path, err))
+		}
+		this.lru.Remove(oldest)
+		delete(this.index, e.path)
+		this.size -= e.size
+	}
+}
+
+// Monitor implements the stores.HealthMonitor interface, checking the health
+// of the cache directory at an interval: while it is unhealthy tiles are
+// loaded straight from the origin, which is also monitored if it can be.
+func (this *Store) Monitor(interval time.Duration) {
+	if hm, ok := this.origin.(stores.HealthMonitor); ok {
+		hm.Monitor(interval)
+	}
+	this.health = stores.NewHealthCheck(this, interval)
+}
+
+func (this *Store) Tile(tileset string, tile *stores.Terrain) error {
+	path, ok := this.path(tileset, tile)
+	if !ok || !this.health.Healthy() {
+		return stores.TimeTile(this.origin, tileset, tile)
+	}
+
+	this.lock.Lock()
+	elem, cached := this.index[path]
+	if cached {
+		this.lru.MoveToFront(elem)
+	}
+	this.lock.Unlock()
+
+	if cached {
+		start := time.Now()
+		body, err := ioutil.ReadFile(path)
+		tile.Timings = append(tile.Timings, stores.Timing{Store: this.String(), Duration: time.Since(start)})
+		if err == nil {
+			atomic.AddUint64(&this.hits, 1)
+			log.Debug(fmt.Sprintf("disk cache: hit: %s", path))
+			tile.Source = this.String()
+			return tile.UnmarshalBinary(body)
+		}
+		// the cache is a convenience so fall back to the origin
+		log.Err(fmt.Sprintf("disk cache: %s", err))
+		this.forget(path)
+	}
+	atomic.AddUint64(&this.misses, 1)
+
+	if err := stores.TimeTile(this.origin, tileset, tile); err != nil {
+		return err
+	}
+	if s, ok := this.origin.(fmt.Stringer); ok && tile.Source == "" {
+		tile.Source = s.String()
+	}
+
+	if err := this.Save(tileset, tile); err != nil {
+		log.Err(fmt.Sprintf("disk cache: cannot save %s: %s", path, err))
+	}
+	return nil
+}
+
+// Remove an entry for a file which can no longer be read.
+func (this *Store) forget(path string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if elem, ok := this.index[path]; ok {
+		this.size -= elem.Value.(*entry).size
+		this.lru.Remove(elem)
+		delete(this.index, path)
+	}
+}
+
+// Write the body of a file to a temporary file in the same directory, which is
+// then renamed to the file so that partially written tiles are never read.
+func writeTemp(filename string, body []byte) (name string, err error) {
+	dir := filepath.Dir(filename)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return
+	}
+	return tmp.Name(), nil
+}
+
+// Save implements the stores.Saver interface, writing a tile to the cache and
+// evicting older tiles if the cache is then too large. Tiles larger than the
+// cache are not saved, nor are stale tiles, being served only as a stopgap
+// while the origin fails.
+func (this *Store) Save(tileset string, tile *stores.Terrain) error {
+	if tile.Stale {
+		return nil
+	}
+
+	path, ok := this.path(tileset, tile)
+	if !ok {
+		return nil
+	}
+
+	body, err := tile.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	size := int64(len(body))
+	if size > this.maxSize {
+		log.Debug(fmt.Sprintf("disk cache: not caching %s: %d bytes is too large", path, size))
+		return nil
+	}
+
+	tmp, err := writeTemp(path, body)
+	if err != nil {
+		return err
+	}
+
+	// The file is renamed into place and indexed together, so that eviction
+	// never sees the file without its entry or vice versa.
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if elem, ok := this.index[path]; ok {
+		e := elem.Value.(*entry)
+		this.size += size - e.size
+		e.size = size
+		this.lru.MoveToFront(elem)
+	} else {
+		this.index[path] = this.lru.PushFront(&entry{path, size})
+		this.size += size
+	}
+	this.evict()
+	return nil
+}
+
+func (this *Store) Layer(tileset string) ([]byte, error) {
+	return this.origin.Layer(tileset)
+}
+
+func (this *Store) TilesetStatus(tileset string) stores.TilesetStatus {
+	return this.origin.TilesetStatus(tileset)
+}
+
+// Variants implements the stores.VariantStorer interface using the origin.
+func (this *Store) Variants(tileset string, tile *stores.Terrain) ([]string, error) {
+	if vs, ok := this.origin.(stores.VariantStorer); ok {
+		return vs.Variants(tileset, tile)
+	}
+	return nil, nil
+}
+
+// Coverage implements the stores.CoverageStorer interface using the origin.
+func (this *Store) Coverage(tileset string) (*stores.Coverage, error) {
+	if cs, ok := this.origin.(stores.CoverageStorer); ok {
+		return cs.Coverage(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// Available implements the stores.AvailabilityStorer interface using the
+// origin.
+func (this *Store) Available(tileset string) ([][]stores.TileRange, error) {
+	if as, ok := this.origin.(stores.AvailabilityStorer); ok {
+		return as.Available(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// Tilesets implements the stores.TilesetLister interface using the origin.
+func (this *Store) Tilesets() ([]string, error) {
+	if tl, ok := this.origin.(stores.TilesetLister); ok {
+		return tl.Tilesets()
+	}
+	return nil, nil
+}
+
+// HashTile implements the stores.HashStorer interface using the origin.
+// Hashed tiles are not cached.
+func (this *Store) HashTile(tileset, hash string, tile *stores.Terrain) error {
+	if hs, ok := this.origin.(stores.HashStorer); ok {
+		return hs.HashTile(tileset, hash, tile)
+	}
+	return stores.ErrNoItem
+}
+
+// HashManifest implements the stores.HashStorer interface using the origin.
+func (this *Store) HashManifest(tileset string) ([]byte, error) {
+	if hs, ok := this.origin.(stores.HashStorer); ok {
+		return hs.HashManifest(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// ResolveName implements the stores.NameResolver interface using the origin.
+func (this *Store) ResolveName(tileset string) (string, error) {
+	if nr, ok := this.origin.(stores.NameResolver); ok {
+		return nr.ResolveName(tileset)
+	}
+	return "", stores.ErrNoItem
+}
+
+// CacheStats implements the stores.CacheStatter interface.
+func (this *Store) CacheStats() stores.CacheStats {
+	this.lock.Lock()
+	size, entries := this.size, this.lru.Len()
+	this.lock.Unlock()
+
+	return stores.CacheStats{
+		Size:    size,
+		MaxSize: this.maxSize,
+		Entries: int64(entries),
+		Hits:    atomic.LoadUint64(&this.hits),
+		Misses:  atomic.LoadUint64(&this.misses),
+	}
+}
+
+// Describe implements the stores.Describer interface. The store is healthy if
+// the cache directory exists.
+func (this *Store) Describe() (desc stores.Description) {
+	this.lock.Lock()
+	size, files := this.size, this.lru.Len()
+	this.lock.Unlock()
+
+	desc.Type = this.String()
+	desc.Config = map[string]string{
+		"dir":      this.dir,
+		"max_size": strconv.FormatInt(this.maxSize, 10),
+		"size":     strconv.FormatInt(size, 10),
+		"files":    strconv.Itoa(files),
+	}
+
+	if info, err := os.Stat(this.dir); err != nil {
+		desc.Error = err.Error()
+	} else if !info.IsDir() {
+		desc.Error = fmt.Sprintf("%s is not a directory", this.dir)
+	} else {
+		desc.Healthy = true
+	}
+	return
+}
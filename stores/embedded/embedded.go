@@ -0,0 +1,109 @@
+// Package embedded provides a store for tilesets compiled into the binary.
+// Tilesets placed under `data/tilesets` are embedded by go-bindata in the
+// assets package when the server is built, allowing a small tileset to be
+// distributed as a single self contained executable.
+package embedded
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/assets"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The asset directory under which tilesets are embedded.
+const DefaultPrefix = "data/tilesets"
+
+type Store struct {
+	prefix string
+}
+
+func New(prefix string) stores.Storer {
+	return &Store{
+		prefix: prefix,
+	}
+}
+
+func (this *Store) String() string {
+	return "embedded"
+}
+
+// Return the asset name of a file in a tileset, rejecting tileset names that
+// would resolve outside of the prefix.
+func (this *Store) assetName(tileset string, elem ...string) (name string, ok bool) {
+	for _, segment := range strings.Split(tileset, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return
+		}
+	}
+
+	return path.Join(append([]string{this.prefix, tileset}, elem...)...), true
+}
+
+// The generated asset functions only fail if the asset does not exist, so all
+// errors are treated as missing items.
+func (this *Store) asset(name string) (body []byte, err error) {
+	body, err = assets.Asset(name)
+	if err != nil {
+		log.Debug(fmt.Sprintf("embedded store: not found: %s", name))
+		err = stores.ErrNoItem
+		return
+	}
+
+	log.Debug(fmt.Sprintf("embedded store: load: %s", name))
+	return
+}
+
+// Load an embedded terrain tile into the Terrain structure.
+func (this *Store) Tile(tileset string, tile *stores.Terrain) (err error) {
+	name, ok := this.assetName(
+		tileset,
+		strconv.FormatUint(tile.Z, 10),
+		strconv.FormatUint(tile.X, 10),
+		strconv.FormatUint(tile.Y, 10)+".terrain")
+	if !ok {
+		return stores.ErrNoItem
+	}
+
+	body, err := this.asset(name)
+	if err != nil {
+		return
+	}
+
+	err = tile.UnmarshalBinary(body)
+	return
+}
+
+func (this *Store) Layer(tileset string) ([]byte, error) {
+	name, ok := this.assetName(tileset, "layer.json")
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+
+	return this.asset(name)
+}
+
+func (this *Store) TilesetStatus(tileset string) (status stores.TilesetStatus) {
+	name, ok := this.assetName(tileset)
+	if !ok {
+		return stores.NOT_FOUND
+	}
+
+	if _, err := assets.AssetDir(name); err != nil {
+		return stores.NOT_FOUND
+	}
+
+	return stores.FOUND
+}
+
+// Describe implements the stores.Describer interface.
+func (this *Store) Describe() stores.Description {
+	return stores.Description{
+		Type:    this.String(),
+		Config:  map[string]string{"prefix": this.prefix},
+		Healthy: true,
+	}
+}
@@ -4,28 +4,166 @@ import (
 	"fmt"
 	"github.com/geo-data/cesium-terrain-server/log"
 	"github.com/geo-data/cesium-terrain-server/stores"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// The file name suffixes of precompressed tile variants, keyed by content
+// encoding. A variant is stored alongside the gzipped tile, e.g.
+// `0.terrain.br` alongside `0.terrain`.
+var PRECOMPRESSED_SUFFIXES = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+}
+
 type Store struct {
 	root string
+
+	// The number of times a read is retried when it fails with a transient
+	// error such as ESTALE or EIO on a network filesystem (e.g. after an NFS
+	// server failover).
+	Retries int
+	// The delay before each retry.
+	RetryDelay time.Duration
+
+	// If set, tiles last modified longer ago than this are stale and are
+	// treated as missing, so that e.g. an overlay serves them from another
+	// store.
+	MaxAge time.Duration
+
+	// The layout of tiles within tileset directories, DEFAULT_LAYOUT if
+	// empty. See ValidateLayout.
+	Layout string
+
+	// Tile files smaller than this many bytes (e.g. empty files left by an
+	// interrupted generation) are treated as missing, so that the tiles are
+	// served from another store or as blank tiles. They are logged so that
+	// they can be cleaned up.
+	MinSize int64
+
+	slots chan struct{} // limits concurrent reads and writes, if not nil
 }
 
-func New(root string) stores.Storer {
+func New(root string) *Store {
 	return &Store{
 		root: root,
 	}
 }
 
+// Limit caps the number of tiles read or written concurrently, e.g. to avoid
+// being throttled by a network filesystem. Further reads and writes wait
+// until one completes. Zero means unlimited.
+func (this *Store) Limit(max int) {
+	if max > 0 {
+		this.slots = make(chan struct{}, max)
+	} else {
+		this.slots = nil
+	}
+}
+
+// Wait for a free slot if concurrency is limited, returning the function
+// which frees it.
+func (this *Store) acquire() func() {
+	if this.slots == nil {
+		return func() {}
+	}
+
+	this.slots <- struct{}{}
+	return func() { <-this.slots }
+}
+
+// Return the directory containing a tileset. Tileset names may contain
+// multiple path segments (e.g. `world/europe`) but names that could resolve
+// outside of the root directory are rejected.
+func (this *Store) tilesetDir(tileset string) (dir string, ok bool) {
+	if strings.ContainsRune(tileset, '\\') {
+		return
+	}
+
+	for _, segment := range strings.Split(tileset, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return
+		}
+	}
+
+	return filepath.Join(this.root, filepath.FromSlash(tileset)), true
+}
+
+// ResolveName implements the NameResolver interface, matching each segment of
+// the tileset name against the directories in the store regardless of case.
+// An exact match is preferred over other matches.
+func (this *Store) ResolveName(tileset string) (string, error) {
+	if _, ok := this.tilesetDir(tileset); !ok {
+		return "", stores.ErrNoItem
+	}
+
+	dir := this.root
+	segments := strings.Split(tileset, "/")
+	for i, segment := range segments {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = stores.ErrNoItem
+			}
+			return "", err
+		}
+
+		match := ""
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.EqualFold(entry.Name(), segment) {
+				continue
+			}
+
+			match = entry.Name()
+			if match == segment {
+				break
+			}
+		}
+		if match == "" {
+			return "", stores.ErrNoItem
+		}
+
+		segments[i] = match
+		dir = filepath.Join(dir, match)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func (this *Store) String() string {
+	return "fs"
+}
+
+// Return true if a filesystem error may succeed if the operation is retried.
+func isTransient(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ESTALE || pe.Err == syscall.EIO
+	}
+	return false
+}
+
 func (this *Store) readFile(filename string) (body []byte, err error) {
 	body, err = ioutil.ReadFile(filename)
+	for attempt := 0; attempt < this.Retries && isTransient(err); attempt++ {
+		log.Notice(fmt.Sprintf("file store: retrying %s: %s", filename, err))
+		time.Sleep(this.RetryDelay)
+		body, err = ioutil.ReadFile(filename)
+	}
+
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Debug(fmt.Sprintf("file store: not found: %s", filename))
 			err = stores.ErrNoItem
+		} else if isTransient(err) {
+			log.Err(fmt.Sprintf("file store: %s", err))
+			err = stores.ErrUnavailable
 		}
 		return
 	}
@@ -34,32 +172,192 @@ func (this *Store) readFile(filename string) (body []byte, err error) {
 	return
 }
 
+// Return true if a file is older than the maximum age. Files which can't be
+// checked are left for reading to report the error.
+func (this *Store) stale(filename string) bool {
+	if this.MaxAge <= 0 {
+		return false
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil || time.Since(info.ModTime()) <= this.MaxAge {
+		return false
+	}
+
+	log.Debug(fmt.Sprintf("file store: stale: %s", filename))
+	return true
+}
+
+// Return true if a tile file is smaller than the minimum size, logging it.
+func (this *Store) truncated(filename string, size int64) bool {
+	if size >= this.MinSize {
+		return false
+	}
+
+	log.Notice(fmt.Sprintf("file store: ignoring %s: %d bytes is below the minimum tile size", filename, size))
+	return true
+}
+
 // Load a terrain tile on disk into the Terrain structure.
-func (this *Store) Tile(tileset string, tile *stores.Terrain) (err error) {
-	filename := filepath.Join(
-		this.root,
-		tileset,
-		strconv.FormatUint(tile.Z, 10),
-		strconv.FormatUint(tile.X, 10),
-		strconv.FormatUint(tile.Y, 10)+".terrain")
+func (this *Store) Tile(tileset string, tile *stores.Terrain) error {
+	return this.load(tileset, tile, true)
+}
+
+// StaleTile implements the stores.StaleStorer interface, loading a tile
+// regardless of its age.
+func (this *Store) StaleTile(tileset string, tile *stores.Terrain) error {
+	return this.load(tileset, tile, false)
+}
+
+// Load a tile, treating it as missing if it is stale and checkAge is set.
+func (this *Store) load(tileset string, tile *stores.Terrain, checkAge bool) (err error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		err = stores.ErrNoItem
+		return
+	}
+
+	defer this.acquire()()
+
+	filename := this.tilePath(dir, tile)
+	if checkAge && this.stale(filename) {
+		err = stores.ErrNoItem
+		return
+	}
+
+	// Prefer a precompressed variant acceptable to the client.
+	for _, encoding := range tile.AcceptEncodings {
+		suffix, ok := PRECOMPRESSED_SUFFIXES[encoding]
+		if !ok {
+			continue
+		}
+
+		body, err := this.readFile(filename + suffix)
+		if err == stores.ErrNoItem || (err == nil && this.truncated(filename+suffix, int64(len(body)))) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		tile.Encoding = encoding
+		return tile.UnmarshalBinary(body)
+	}
 
 	body, err := this.readFile(filename)
 	if err != nil {
 		return
+	} else if this.truncated(filename, int64(len(body))) {
+		err = stores.ErrNoItem
+		return
 	}
 
 	err = tile.UnmarshalBinary(body)
 	return
 }
 
+// TileFile implements the stores.FileStorer interface. Precompressed variants
+// are not considered.
+func (this *Store) TileFile(tileset string, tile *stores.Terrain) (*os.File, error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+
+	defer this.acquire()()
+
+	filename := this.tilePath(dir, tile)
+	if this.stale(filename) {
+		return nil, stores.ErrNoItem
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debug(fmt.Sprintf("file store: not found: %s", filename))
+			err = stores.ErrNoItem
+		} else if isTransient(err) {
+			log.Err(fmt.Sprintf("file store: %s", err))
+			err = stores.ErrUnavailable
+		}
+		return nil, err
+	}
+
+	if this.MinSize > 0 {
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		} else if this.truncated(filename, fi.Size()) {
+			file.Close()
+			return nil, stores.ErrNoItem
+		}
+	}
+
+	log.Debug(fmt.Sprintf("file store: open: %s", filename))
+	return file, nil
+}
+
+// Stat implements the StatStorer interface, describing a tile from its file
+// information and the first bytes of the file, which identify gzipped tiles.
+func (this *Store) Stat(tileset string, tile *stores.Terrain) (*stores.TileInfo, error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+
+	filename := this.tilePath(dir, tile)
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = stores.ErrNoItem
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	} else if this.truncated(filename, fi.Size()) {
+		return nil, stores.ErrNoItem
+	}
+
+	info := &stores.TileInfo{
+		Store:    this.String(),
+		Size:     fi.Size(),
+		Encoding: "identity",
+		Modified: fi.ModTime(),
+	}
+
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	switch {
+	case n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		info.Encoding = "gzip"
+	case n == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		info.Encoding = "zstd"
+	}
+	return info, nil
+}
+
 func (this *Store) Layer(tileset string) ([]byte, error) {
-	filename := filepath.Join(this.root, tileset, "layer.json")
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+
+	filename := filepath.Join(dir, "layer.json")
 	return this.readFile(filename)
 }
 
 func (this *Store) TilesetStatus(tileset string) (status stores.TilesetStatus) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return stores.NOT_FOUND
+	}
+
 	// check whether the tile directory exists
-	_, err := os.Stat(filepath.Join(this.root, tileset))
+	_, err := os.Stat(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return stores.NOT_FOUND
@@ -68,3 +366,295 @@ func (this *Store) TilesetStatus(tileset string) (status stores.TilesetStatus) {
 
 	return stores.FOUND
 }
+
+// Variants implements the stores.VariantStorer interface. Tiles on the
+// filesystem are offered as heightmaps: tilesets in other formats are declared
+// in the server's tileset configuration, which takes precedence.
+func (this *Store) Variants(tileset string, tile *stores.Terrain) ([]string, error) {
+	return []string{stores.HEIGHTMAP_MEDIA_TYPE}, nil
+}
+
+// Coverage implements the stores.CoverageStorer interface, loading the mask
+// from the `coverage.pbm` file in the tileset directory.
+func (this *Store) Coverage(tileset string) (*stores.Coverage, error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+
+	body, err := this.readFile(filepath.Join(dir, "coverage.pbm"))
+	if err != nil {
+		return nil, err
+	}
+
+	return stores.ParseCoverage(body)
+}
+
+// The depth of directories searched for tilesets by Tilesets, allowing for
+// nested tileset names such as `world/europe`.
+const MAX_TILESET_DEPTH = 4
+
+// Tilesets implements the stores.TilesetLister interface. A directory is a
+// tileset if it contains a `layer.json` or zoom level directories.
+func (this *Store) Tilesets() ([]string, error) {
+	var tilesets []string
+	var walk func(dir, name string, depth int) error
+	walk = func(dir, name string, depth int) error {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		isTileset := false
+		for _, info := range infos {
+			entry := info.Name()
+			if entry == "layer.json" {
+				isTileset = true
+			} else if !info.IsDir() || strings.HasPrefix(entry, ".") {
+				continue
+			} else if _, err := strconv.ParseUint(entry, 10, 64); err == nil {
+				isTileset = true
+			} else if depth < MAX_TILESET_DEPTH {
+				if err := walk(filepath.Join(dir, entry), path.Join(name, entry), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		if isTileset && name != "" {
+			tilesets = append(tilesets, name)
+		}
+		return nil
+	}
+
+	if err := walk(this.root, "", 0); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(tilesets)
+	return tilesets, nil
+}
+
+// Return the numeric entries of a directory, skipping other files. If suffix
+// is not empty only entries with that suffix are returned, with the suffix
+// removed.
+func numericEntries(dir, suffix string) (values []uint64, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if suffix != "" {
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			name = name[:len(name)-len(suffix)]
+		}
+
+		if value, err := strconv.ParseUint(name, 10, 64); err == nil {
+			values = append(values, value)
+		}
+	}
+
+	sort.Sort(uint64s(values))
+	return
+}
+
+type uint64s []uint64
+
+func (a uint64s) Len() int           { return len(a) }
+func (a uint64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// Available implements the stores.AvailabilityStorer interface by scanning the
+// tileset directory for tiles. Contiguous runs of tiles are merged into
+// rectangular ranges. Only tilesets in the standard layout can be scanned.
+func (this *Store) Available(tileset string) (available [][]stores.TileRange, err error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok || !this.standardLayout() {
+		err = stores.ErrNoItem
+		return
+	}
+
+	zooms, err := numericEntries(dir, "")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = stores.ErrNoItem
+		}
+		return
+	}
+
+	for _, z := range zooms {
+		zdir := filepath.Join(dir, strconv.FormatUint(z, 10))
+		xs, err := numericEntries(zdir, "")
+		if err != nil {
+			return nil, err
+		}
+
+		// Ranges which may be extended by the next column, keyed by
+		// their y extent.
+		ranges := []stores.TileRange{}
+		open := make(map[[2]uint64]int)
+		for _, x := range xs {
+			ys, err := numericEntries(filepath.Join(zdir, strconv.FormatUint(x, 10)), ".terrain")
+			if err != nil {
+				return nil, err
+			}
+
+			next := make(map[[2]uint64]int)
+			for i := 0; i < len(ys); {
+				// find the run of contiguous y values starting at i
+				j := i
+				for j+1 < len(ys) && ys[j+1] == ys[j]+1 {
+					j++
+				}
+
+				extent := [2]uint64{ys[i], ys[j]}
+				if idx, ok := open[extent]; ok && ranges[idx].EndX+1 == x {
+					ranges[idx].EndX = x
+					next[extent] = idx
+				} else {
+					ranges = append(ranges, stores.TileRange{
+						StartX: x,
+						StartY: ys[i],
+						EndX:   x,
+						EndY:   ys[j],
+					})
+					next[extent] = len(ranges) - 1
+				}
+				i = j + 1
+			}
+			open = next
+		}
+
+		for uint64(len(available)) < z {
+			available = append(available, []stores.TileRange{})
+		}
+		available = append(available, ranges)
+	}
+	return
+}
+
+// Write a file atomically. The data is written to a uniquely named temporary
+// file in the same directory which is then renamed, so readers never see a
+// partially written file and concurrent writes of the same file can't
+// interleave: the last rename wins.
+func writeFile(filename string, body []byte) (err error) {
+	dir := filepath.Dir(filename)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Save implements the stores.Saver interface, writing a tile to the tileset
+// directory. Tiles are written atomically so concurrent saves of the same
+// tile are safe.
+func (this *Store) Save(tileset string, tile *stores.Terrain) error {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return stores.ErrNoItem
+	}
+
+	body, err := tile.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	filename := this.tilePath(dir, tile)
+	if suffix, ok := PRECOMPRESSED_SUFFIXES[tile.Encoding]; ok {
+		filename += suffix
+	}
+
+	release := this.acquire()
+	err = writeFile(filename, body)
+	release()
+	if err != nil {
+		return err
+	}
+
+	log.Debug(fmt.Sprintf("file store: save: %s", filename))
+	return nil
+}
+
+// SaveLayer writes a `layer.json` file to the tileset directory.
+func (this *Store) SaveLayer(tileset string, body []byte) error {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return stores.ErrNoItem
+	}
+
+	return writeFile(filepath.Join(dir, "layer.json"), body)
+}
+
+// Describe implements the stores.Describer interface. The store is healthy if
+// the root directory can be read.
+func (this *Store) Describe() (desc stores.Description) {
+	desc.Type = this.String()
+	desc.Config = map[string]string{"root": this.root}
+	if this.slots != nil {
+		desc.Config["max_concurrent"] = strconv.Itoa(cap(this.slots))
+	}
+
+	dir, err := os.Open(this.root)
+	if err == nil {
+		_, err = dir.Readdirnames(1)
+		dir.Close()
+	}
+
+	if err != nil && err != io.EOF {
+		desc.Error = err.Error()
+	} else {
+		desc.Healthy = true
+	}
+	return
+}
+
+// Zooms implements the stores.ZoomStorer interface from the names of the zoom
+// level directories in the tileset, without scanning the tiles themselves.
+func (this *Store) Zooms(tileset string) (min, max uint64, err error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok || !(this.standardLayout() || strings.HasPrefix(this.Layout, "{z}/")) {
+		err = stores.ErrNoItem
+		return
+	}
+
+	zooms, err := numericEntries(dir, "")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = stores.ErrNoItem
+		}
+		return
+	}
+
+	if len(zooms) == 0 {
+		err = stores.ErrNoItem
+		return
+	}
+
+	return zooms[0], zooms[len(zooms)-1], nil
+}
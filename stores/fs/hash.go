@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// The directory within a tileset holding its tiles by content hash, as
+// `h/<hash>.terrain`. Identical tiles (e.g. the sea) share a single file.
+const HASH_DIR = "h"
+
+// The manifest listing the content hash of each tile in a tileset.
+const HASH_MANIFEST = "hashes.json"
+
+// Hashes are the hex MD5 digests of tiles.
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// HashTile implements the stores.HashStorer interface, loading a tile from the
+// tileset's hash directory.
+func (this *Store) HashTile(tileset, hash string, tile *stores.Terrain) error {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok || !hashPattern.MatchString(hash) {
+		return stores.ErrNoItem
+	}
+
+	defer this.acquire()()
+
+	filename := filepath.Join(dir, HASH_DIR, hash+".terrain")
+	body, err := this.readFile(filename)
+	if err != nil {
+		return err
+	} else if this.truncated(filename, int64(len(body))) {
+		return stores.ErrNoItem
+	}
+	return tile.UnmarshalBinary(body)
+}
+
+// HashManifest implements the stores.HashStorer interface, reading the
+// tileset's manifest.
+func (this *Store) HashManifest(tileset string) ([]byte, error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+	return this.readFile(filepath.Join(dir, HASH_MANIFEST))
+}
+
+// The manifest of a tileset's hashed tiles.
+type hashManifest struct {
+	// The url of the hashed tiles relative to the tileset.
+	Template string `json:"template"`
+	// The hash of each tile keyed by its `z/x/y` coordinate.
+	Tiles map[string]string `json:"tiles"`
+}
+
+// WriteHashes adds each tile in a tileset to the tileset's hash directory and
+// writes its manifest, returning the number of tiles and of distinct hashes.
+// Tiles are hard linked where possible rather than copied. Only tilesets in
+// the default layout can be scanned.
+func (this *Store) WriteHashes(tileset string) (tiles, hashes int, err error) {
+	dir, ok := this.tilesetDir(tileset)
+	if !ok {
+		err = stores.ErrNoItem
+		return
+	}
+
+	available, err := this.Available(tileset)
+	if err != nil {
+		return
+	}
+
+	manifest := hashManifest{
+		Template: HASH_DIR + "/{hash}.terrain",
+		Tiles:    make(map[string]string),
+	}
+	seen := make(map[string]bool)
+	for z, ranges := range available {
+		for _, r := range ranges {
+			for x := r.StartX; x <= r.EndX; x++ {
+				for y := r.StartY; y <= r.EndY; y++ {
+					tile := stores.Terrain{X: x, Y: y, Z: uint64(z)}
+					if err = this.Tile(tileset, &tile); err == stores.ErrNoItem {
+						err = nil // e.g. below the minimum size
+						continue
+					} else if err != nil {
+						return
+					}
+
+					hash := hex.EncodeToString(tile.MD5())
+					manifest.Tiles[fmt.Sprintf("%d/%d/%d", z, x, y)] = hash
+					tiles++
+					if seen[hash] {
+						continue
+					}
+					seen[hash] = true
+
+					if err = this.linkHash(this.tilePath(dir, &tile), filepath.Join(dir, HASH_DIR, hash+".terrain")); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+	hashes = len(seen)
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFile(filepath.Join(dir, HASH_MANIFEST), body)
+	return
+}
+
+// Add a tile file to the hash directory, copying it if it can't be linked.
+// Existing hashed files are left as they are, having the same content.
+func (this *Store) linkHash(source, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(source, target); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	body, err := this.readFile(source)
+	if err != nil {
+		return err
+	}
+	return writeFile(target, body)
+}
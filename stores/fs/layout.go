@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_LAYOUT is the standard layout of tiles within a tileset directory.
+const DEFAULT_LAYOUT = "{z}/{x}/{y}.terrain"
+
+// Placeholders in a layout. `{h1}`, `{h2}` and `{h3}` are successive pairs of
+// hex digits from the 32 bit FNV-1a hash of the tile's `x/y` coordinates, used
+// to shard tiles between directories so that no directory has too many
+// entries.
+var layoutPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+var layoutNames = map[string]bool{
+	"{z}": true, "{x}": true, "{y}": true,
+	"{h1}": true, "{h2}": true, "{h3}": true,
+}
+
+// ValidateLayout checks that a layout template, e.g.
+// `{z}/{h1}/{h2}/{x}/{y}.terrain`, uses known placeholders and identifies
+// each tile.
+func ValidateLayout(layout string) error {
+	for _, name := range layoutPlaceholder.FindAllString(layout, -1) {
+		if !layoutNames[name] {
+			return fmt.Errorf("bad layout %s: unknown placeholder %s", layout, name)
+		}
+	}
+
+	for _, name := range []string{"{z}", "{x}", "{y}"} {
+		if !strings.Contains(layout, name) {
+			return fmt.Errorf("bad layout %s: %s is required", layout, name)
+		}
+	}
+
+	for _, segment := range strings.Split(layout, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("bad layout %s: empty or relative path segment", layout)
+		}
+	}
+	return nil
+}
+
+// Return true if the store uses the standard layout, which can be scanned for
+// available tiles.
+func (this *Store) standardLayout() bool {
+	return this.Layout == "" || this.Layout == DEFAULT_LAYOUT
+}
+
+// Return the path to a tile in a tileset directory.
+func (this *Store) tilePath(dir string, tile *stores.Terrain) string {
+	z := strconv.FormatUint(tile.Z, 10)
+	x := strconv.FormatUint(tile.X, 10)
+	y := strconv.FormatUint(tile.Y, 10)
+	if this.standardLayout() {
+		return filepath.Join(dir, z, x, y+".terrain")
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(x + "/" + y))
+	hash := fmt.Sprintf("%08x", h.Sum32())
+
+	path := strings.NewReplacer(
+		"{z}", z, "{x}", x, "{y}", y,
+		"{h1}", hash[0:2], "{h2}", hash[2:4], "{h3}", hash[4:6],
+	).Replace(this.Layout)
+	return filepath.Join(dir, filepath.FromSlash(path))
+}
@@ -0,0 +1,124 @@
+package stores
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthMonitor periodically checks the health of the stores composing a
+// store, so that unhealthy stores can be skipped until they recover. Stores
+// which can't describe their health are always considered healthy.
+type healthMonitor struct {
+	stores  []Storer
+	healthy []int32 // 1 if the store at the same index is healthy
+}
+
+// Start monitoring the health of stores at an interval.
+func monitorHealth(stores []Storer, interval time.Duration) *healthMonitor {
+	monitor := &healthMonitor{
+		stores:  stores,
+		healthy: make([]int32, len(stores)),
+	}
+	for i := range monitor.healthy {
+		monitor.healthy[i] = 1
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			monitor.check()
+		}
+	}()
+	return monitor
+}
+
+// Check the health of each store, logging any changes.
+func (this *healthMonitor) check() {
+	for i, store := range this.stores {
+		describer, ok := store.(Describer)
+		if !ok {
+			continue
+		}
+
+		desc := describer.Describe()
+		healthy := int32(0)
+		if desc.Healthy {
+			healthy = 1
+		}
+
+		if atomic.SwapInt32(&this.healthy[i], healthy) != healthy {
+			if desc.Healthy {
+				log.Notice(fmt.Sprintf("store %s has recovered", storeName(store)))
+			} else {
+				log.Err(fmt.Sprintf("store %s is unhealthy and will be skipped: %s", storeName(store), desc.Error))
+			}
+		}
+	}
+}
+
+// Return true unless the store at an index is known to be unhealthy. A nil
+// monitor reports all stores as healthy.
+func (this *healthMonitor) ok(i int) bool {
+	return this == nil || atomic.LoadInt32(&this.healthy[i]) == 1
+}
+
+// Return a description of a composite store listing the stores which are
+// being skipped. The store is healthy if any of its stores are.
+func (this *healthMonitor) describe(kind string, stores []Storer) (desc Description) {
+	desc.Type = kind
+	desc.Config = make(map[string]string)
+
+	var excluded []string
+	for i, store := range stores {
+		if this.ok(i) {
+			desc.Healthy = true
+		} else {
+			excluded = append(excluded, storeName(store))
+		}
+	}
+
+	if this == nil {
+		desc.Config["health_checks"] = "disabled"
+	} else if len(excluded) > 0 {
+		desc.Config["excluded"] = strings.Join(excluded, ",")
+		if !desc.Healthy {
+			desc.Error = "all stores are unhealthy"
+		}
+	}
+	return
+}
+
+// HealthCheck periodically checks the health of a single store, e.g. a cache
+// which is bypassed while it is unhealthy.
+type HealthCheck struct {
+	monitor *healthMonitor
+}
+
+// NewHealthCheck starts checking the health of a store at an interval.
+func NewHealthCheck(store Storer, interval time.Duration) *HealthCheck {
+	return &HealthCheck{monitorHealth([]Storer{store}, interval)}
+}
+
+// Healthy returns true unless the store is known to be unhealthy. A nil
+// HealthCheck reports the store as healthy.
+func (this *HealthCheck) Healthy() bool {
+	return this == nil || this.monitor.ok(0)
+}
+
+// Record the store within list which loaded a tile, unless a store nested
+// within it already has.
+func setSource(tile *Terrain, list []Storer, index int) {
+	if tile.Source == "" {
+		tile.Source = fmt.Sprintf("%s[%d]", storeName(list[index]), index)
+	}
+}
+
+// Return the name of a store.
+func storeName(store Storer) string {
+	if s, ok := store.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", store)
+}
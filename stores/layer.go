@@ -0,0 +1,137 @@
+package stores
+
+// TileRange is a rectangle of tiles at a zoom level, as listed in the
+// `available` property of a `layer.json` file.
+type TileRange struct {
+	StartX uint64 `json:"startX"`
+	StartY uint64 `json:"startY"`
+	EndX   uint64 `json:"endX"`
+	EndY   uint64 `json:"endY"`
+}
+
+// AvailabilityStorer is implemented by stores which can determine the tiles
+// present in a tileset. The ranges of tiles available at each zoom level are
+// returned, indexed by zoom level.
+type AvailabilityStorer interface {
+	Storer
+	Available(tileset string) ([][]TileRange, error)
+}
+
+// ZoomStorer is implemented by stores which can cheaply determine the range of
+// zoom levels present in a tileset.
+type ZoomStorer interface {
+	Storer
+	Zooms(tileset string) (min, max uint64, err error)
+}
+
+// Layer represents the `layer.json` document describing a tileset.
+type Layer struct {
+	Tilejson  string        `json:"tilejson"`
+	Format    string        `json:"format"`
+	Version   string        `json:"version"`
+	Scheme    string        `json:"scheme"`
+	Tiles     []string      `json:"tiles"`
+	Minzoom   *uint64       `json:"minzoom,omitempty"` // nil if the zoom extent is unknown
+	Maxzoom   *uint64       `json:"maxzoom,omitempty"`
+	Bounds    []float64     `json:"bounds,omitempty"`
+	Available [][]TileRange `json:"available,omitempty"`
+}
+
+// Tileset formats with default Layer templates.
+const (
+	HEIGHTMAP_FORMAT      = "heightmap-1.0"
+	QUANTIZED_MESH_FORMAT = "quantized-mesh-1.0"
+)
+
+// Templates for the Layers describing tilesets for which nothing other than
+// the format is known, keyed by format.
+var layerTemplates = map[string]Layer{
+	HEIGHTMAP_FORMAT: {
+		Tilejson: "2.1.0",
+		Format:   HEIGHTMAP_FORMAT,
+		Version:  "1.0.0",
+		Scheme:   "tms",
+		Tiles:    []string{"{z}/{x}/{y}.terrain"},
+	},
+	QUANTIZED_MESH_FORMAT: {
+		Tilejson: "2.1.0",
+		Format:   QUANTIZED_MESH_FORMAT,
+		Version:  "1.0.0",
+		Scheme:   "tms",
+		Tiles:    []string{"{z}/{x}/{y}.terrain"},
+	},
+}
+
+// DefaultLayer returns a Layer describing a tileset in the given format from
+// its template. Unknown formats are described as heightmaps.
+func DefaultLayer(format string) *Layer {
+	template, ok := layerTemplates[format]
+	if !ok {
+		template = layerTemplates[HEIGHTMAP_FORMAT]
+	}
+
+	layer := template
+	layer.Tiles = append([]string(nil), template.Tiles...)
+	return &layer
+}
+
+// SetZoomExtent records the range of zoom levels in which the tileset has
+// tiles.
+func (this *Layer) SetZoomExtent(min, max uint64) {
+	this.Minzoom, this.Maxzoom = &min, &max
+}
+
+// NewLayer returns a heightmap Layer describing the available tiles. The zoom
+// extent and the geographic bounds are derived from the tile ranges.
+func NewLayer(available [][]TileRange) *Layer {
+	layer := DefaultLayer(HEIGHTMAP_FORMAT)
+	layer.Available = available
+
+	var min, max uint64
+	found := false
+	for zoom, ranges := range available {
+		if len(ranges) == 0 {
+			continue
+		}
+
+		if !found {
+			min = uint64(zoom)
+			found = true
+		}
+		max = uint64(zoom)
+	}
+
+	if found {
+		layer.SetZoomExtent(min, max)
+		layer.Bounds = bounds(max, available[max])
+	}
+	return layer
+}
+
+// Return the west, south, east, north bounds in degrees of the tile ranges at
+// a zoom level in the geographic TMS tiling scheme.
+func bounds(zoom uint64, ranges []TileRange) []float64 {
+	r := ranges[0]
+	for _, other := range ranges[1:] {
+		if other.StartX < r.StartX {
+			r.StartX = other.StartX
+		}
+		if other.StartY < r.StartY {
+			r.StartY = other.StartY
+		}
+		if other.EndX > r.EndX {
+			r.EndX = other.EndX
+		}
+		if other.EndY > r.EndY {
+			r.EndY = other.EndY
+		}
+	}
+
+	size := 180 / float64(uint64(1)<<zoom) // the tile size in degrees
+	return []float64{
+		-180 + float64(r.StartX)*size,
+		-90 + float64(r.StartY)*size,
+		-180 + float64(r.EndX+1)*size,
+		-90 + float64(r.EndY+1)*size,
+	}
+}
@@ -0,0 +1,472 @@
+// Package memcache provides a store which caches the tiles of another store in
+// memcache. Tiles are read from memcache where possible, falling back to the
+// origin store and saving the tiles it returns to memcache.
+package memcache
+
+import (
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default size of the chunks in which tiles too large for a single item
+// are saved, leaving room within memcache's default 1MB item limit for the
+// item's key and metadata.
+const DEFAULT_CHUNK_SIZE = 1000 * 1024
+
+// Tiles are touched in the background by this many goroutines, with up to
+// TOUCH_QUEUE_SIZE tiles waiting. Touches are dropped when the queue is full:
+// they only extend the life of tiles.
+const (
+	TOUCH_WORKERS    = 4
+	TOUCH_QUEUE_SIZE = 128
+)
+
+// memcache treats expiration times longer than this many seconds (30 days) as
+// absolute Unix times rather than relative to the present.
+const MAX_RELATIVE_EXPIRATION = 30 * 24 * 60 * 60
+
+// Item flags. The low byte records the content encoding of the tile.
+const (
+	FLAG_CHUNKED  uint32 = 1 << 8 // the item is a manifest listing the number of chunks
+	ENCODING_MASK uint32 = 0xff
+)
+
+// Content encodings recorded in item flags. Zero means the encoding is unknown.
+var encodings = []string{"", "gzip", "identity", "br", "zstd"}
+
+// Options configures the store.
+type Options struct {
+	// The maximum size of an item. Larger tiles are split into chunks of
+	// this size, saved under separate keys alongside a manifest recording
+	// the number of chunks. If zero DEFAULT_CHUNK_SIZE is used.
+	ChunkSize int
+	// Don't split large tiles into chunks: tiles larger than ChunkSize are
+	// not cached.
+	NoChunking bool
+	// The expiration time of items in seconds. Zero means no expiration.
+	// Times longer than MAX_RELATIVE_EXPIRATION are supported.
+	Expiration int32
+	// Expiration times for ranges of zoom levels, overriding Expiration for
+	// tiles within them.
+	Bands []ExpirationBand
+	// Reset the expiration time of tiles when they are read, so that
+	// frequently requested tiles stay cached while others expire.
+	Touch bool
+	// The prefix added to keys, allowing servers to share memcache.
+	Prefix string
+	// The maximum number of idle connections kept open to each memcache
+	// server. If zero memcache.DefaultMaxIdleConns is used.
+	MaxIdleConns int
+	// The socket read/write timeout. If zero memcache.DefaultTimeout is used.
+	Timeout time.Duration
+}
+
+// ExpirationBand sets the expiration time of tiles in a range of zoom levels,
+// e.g. so that frequently requested low zoom tiles are cached for longer than
+// high zoom tiles.
+type ExpirationBand struct {
+	MinZoom, MaxZoom uint64
+	Expiration       int32 // in seconds: zero means no expiration
+}
+
+// String describes the band's zoom range e.g. `6-12` or `13+`.
+func (this ExpirationBand) String() string {
+	if this.MaxZoom == math.MaxUint64 {
+		return fmt.Sprintf("%d+", this.MinZoom)
+	}
+	return fmt.Sprintf("%d-%d", this.MinZoom, this.MaxZoom)
+}
+
+// ValidateBands checks that expiration bands don't overlap.
+func ValidateBands(bands []ExpirationBand) error {
+	for i, a := range bands {
+		if a.MaxZoom < a.MinZoom {
+			return fmt.Errorf("bad zoom range %s", a)
+		}
+
+		for _, b := range bands[:i] {
+			if a.MinZoom <= b.MaxZoom && b.MinZoom <= a.MaxZoom {
+				return fmt.Errorf("zoom ranges %s and %s overlap", b, a)
+			}
+		}
+	}
+	return nil
+}
+
+type Store struct {
+	servers string
+	mc      *memcache.Client
+	origin  stores.Storer
+	options Options
+	touches chan touch          // tiles waiting to be touched
+	health  *stores.HealthCheck // nil unless health checks are enabled
+}
+
+// The items of a tile to be touched.
+type touch struct {
+	keys       []string
+	expiration int32
+}
+
+// New returns a store caching the tiles of the origin store in the memcache
+// servers, a comma separated list of addresses.
+func New(servers string, origin stores.Storer, options Options) *Store {
+	mc := memcache.New(strings.Split(servers, ",")...)
+	mc.MaxIdleConns = options.MaxIdleConns
+	mc.Timeout = options.Timeout
+
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = DEFAULT_CHUNK_SIZE
+	}
+
+	this := &Store{
+		servers: servers,
+		mc:      mc,
+		origin:  origin,
+		options: options,
+	}
+
+	if options.Touch {
+		this.touches = make(chan touch, TOUCH_QUEUE_SIZE)
+		for i := 0; i < TOUCH_WORKERS; i++ {
+			go this.toucher()
+		}
+	}
+	return this
+}
+
+func (this *Store) String() string {
+	return "memcache"
+}
+
+// Monitor implements the stores.HealthMonitor interface, checking the health
+// of memcache at an interval: while memcache is unhealthy tiles are loaded
+// straight from the origin, which is also monitored if it can be.
+func (this *Store) Monitor(interval time.Duration) {
+	if hm, ok := this.origin.(stores.HealthMonitor); ok {
+		hm.Monitor(interval)
+	}
+	this.health = stores.NewHealthCheck(this, interval)
+}
+
+// Origin returns the store whose tiles are cached.
+func (this *Store) Origin() stores.Storer {
+	return this.origin
+}
+
+// Return the key under which a tile is cached.
+func (this *Store) key(tileset string, tile *stores.Terrain) string {
+	key := fmt.Sprintf("%s%s/%d/%d/%d", this.options.Prefix, tileset, tile.Z, tile.X, tile.Y)
+	if tile.MediaType != "" && tile.MediaType != stores.HEIGHTMAP_MEDIA_TYPE {
+		key += ";" + tile.MediaType
+	}
+	if len(tile.AcceptEncodings) > 0 {
+		key += ";" + strings.Join(tile.AcceptEncodings, ",")
+	}
+	return key
+}
+
+// Return the expiration time of a tile at a zoom level, as sent to memcache.
+func (this *Store) expiration(zoom uint64) int32 {
+	seconds := this.options.Expiration
+	for _, band := range this.options.Bands {
+		if zoom >= band.MinZoom && zoom <= band.MaxZoom {
+			seconds = band.Expiration
+			break
+		}
+	}
+	return itemExpiration(seconds, time.Now())
+}
+
+// Convert an expiration time in seconds from now into the value sent to
+// memcache, which must be an absolute Unix time if it is longer than
+// MAX_RELATIVE_EXPIRATION: memcache would otherwise treat it as a time long
+// past and expire the item immediately.
+func itemExpiration(seconds int32, now time.Time) int32 {
+	if seconds <= MAX_RELATIVE_EXPIRATION {
+		return seconds
+	}
+	if expires := now.Unix() + int64(seconds); expires < math.MaxInt32 {
+		return int32(expires)
+	}
+	return math.MaxInt32
+}
+
+// Return the key of a chunk of a tile.
+func chunkKey(key string, chunk int) string {
+	return key + "#" + strconv.Itoa(chunk)
+}
+
+// Return the flags recording a content encoding.
+func encodingFlags(encoding string) uint32 {
+	for i, e := range encodings {
+		if e == encoding {
+			return uint32(i)
+		}
+	}
+	return 0
+}
+
+// Load a tile from memcache, returning ErrNoItem if it isn't cached.
+func (this *Store) get(key string, tile *stores.Terrain) error {
+	item, err := this.mc.Get(key)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			err = stores.ErrNoItem
+		}
+		return err
+	}
+
+	body := item.Value
+	keys := []string{key}
+	if item.Flags&FLAG_CHUNKED != 0 {
+		var chunks []string
+		if body, chunks, err = this.getChunks(key, item.Value); err != nil {
+			return err
+		}
+		keys = append(keys, chunks...)
+	}
+
+	if expiration := this.expiration(tile.Z); this.options.Touch && expiration > 0 {
+		select {
+		case this.touches <- touch{keys, expiration}:
+		default:
+			log.Debug(fmt.Sprintf("memcache store: touch queue full: not touching %s", key))
+		}
+	}
+
+	if i := int(item.Flags & ENCODING_MASK); i < len(encodings) {
+		tile.Encoding = encodings[i]
+	}
+	return tile.UnmarshalBinary(body)
+}
+
+// Touch tiles from the queue.
+func (this *Store) toucher() {
+	for t := range this.touches {
+		this.touch(t.keys, t.expiration)
+	}
+}
+
+// Reset the expiration time of cached items. Chunks are touched before their
+// manifest so that the manifest doesn't outlive them.
+func (this *Store) touch(keys []string, expiration int32) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := this.mc.Touch(keys[i], expiration); err != nil && err != memcache.ErrCacheMiss {
+			log.Err(fmt.Sprintf("memcache store: cannot touch %s: %s", keys[i], err))
+			return
+		}
+	}
+}
+
+// Reassemble a chunked tile from its manifest, returning the keys of the
+// chunks.
+func (this *Store) getChunks(key string, manifest []byte) ([]byte, []string, error) {
+	count, err := strconv.Atoi(string(manifest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad manifest for %s: %s", key, err)
+	}
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = chunkKey(key, i)
+	}
+
+	items, err := this.mc.GetMulti(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body []byte
+	for _, k := range keys {
+		item, ok := items[k]
+		if !ok {
+			return nil, nil, stores.ErrNoItem // a chunk has been evicted
+		}
+		body = append(body, item.Value...)
+	}
+	return body, keys, nil
+}
+
+func (this *Store) Tile(tileset string, tile *stores.Terrain) error {
+	key := this.key(tileset, tile)
+	healthy := this.health.Healthy()
+	if healthy {
+		start := time.Now()
+		err := this.get(key, tile)
+		tile.Timings = append(tile.Timings, stores.Timing{Store: this.String(), Duration: time.Since(start)})
+		if err == nil {
+			log.Debug(fmt.Sprintf("memcache store: hit: %s", key))
+			tile.Source = this.String()
+			return nil
+		} else if err != stores.ErrNoItem {
+			// the cache is a convenience so fall back to the origin
+			log.Err(fmt.Sprintf("memcache store: %s: %s", key, err))
+		}
+	}
+
+	if err := stores.TimeTile(this.origin, tileset, tile); err != nil {
+		return err
+	}
+	if s, ok := this.origin.(fmt.Stringer); ok && tile.Source == "" {
+		tile.Source = s.String()
+	}
+
+	if healthy {
+		if err := this.Save(tileset, tile); err != nil {
+			log.Err(fmt.Sprintf("memcache store: cannot save %s: %s", key, err))
+		}
+	}
+	return nil
+}
+
+// Save implements the stores.Saver interface, saving a tile to memcache.
+// Tiles larger than the chunk size are saved in chunks unless chunking is
+// disabled, in which case they are not saved. Stale tiles are not saved, being
+// served only as a stopgap while the origin fails.
+func (this *Store) Save(tileset string, tile *stores.Terrain) error {
+	if tile.Stale {
+		return nil
+	}
+
+	key := this.key(tileset, tile)
+	body, err := tile.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	flags := encodingFlags(tile.Encoding)
+	expiration := this.expiration(tile.Z)
+	size := this.options.ChunkSize
+	if len(body) <= size {
+		return this.mc.Set(&memcache.Item{Key: key, Value: body, Flags: flags, Expiration: expiration})
+	}
+
+	if this.options.NoChunking {
+		log.Debug(fmt.Sprintf("memcache store: not caching %s: %d bytes is too large", key, len(body)))
+		return nil
+	}
+
+	// Save the chunks before the manifest so that a manifest is never read
+	// before its chunks exist.
+	count := 0
+	for offset := 0; offset < len(body); offset += size {
+		end := offset + size
+		if end > len(body) {
+			end = len(body)
+		}
+
+		item := &memcache.Item{Key: chunkKey(key, count), Value: body[offset:end], Expiration: expiration}
+		if err = this.mc.Set(item); err != nil {
+			return err
+		}
+		count++
+	}
+
+	return this.mc.Set(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.Itoa(count)),
+		Flags:      flags | FLAG_CHUNKED,
+		Expiration: expiration,
+	})
+}
+
+func (this *Store) Layer(tileset string) ([]byte, error) {
+	return this.origin.Layer(tileset)
+}
+
+func (this *Store) TilesetStatus(tileset string) stores.TilesetStatus {
+	return this.origin.TilesetStatus(tileset)
+}
+
+// Variants implements the stores.VariantStorer interface using the origin.
+func (this *Store) Variants(tileset string, tile *stores.Terrain) ([]string, error) {
+	if vs, ok := this.origin.(stores.VariantStorer); ok {
+		return vs.Variants(tileset, tile)
+	}
+	return nil, nil
+}
+
+// Coverage implements the stores.CoverageStorer interface using the origin.
+func (this *Store) Coverage(tileset string) (*stores.Coverage, error) {
+	if cs, ok := this.origin.(stores.CoverageStorer); ok {
+		return cs.Coverage(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// Tilesets implements the stores.TilesetLister interface using the origin.
+func (this *Store) Tilesets() ([]string, error) {
+	if tl, ok := this.origin.(stores.TilesetLister); ok {
+		return tl.Tilesets()
+	}
+	return nil, nil
+}
+
+// Zooms implements the stores.ZoomStorer interface using the origin.
+func (this *Store) Zooms(tileset string) (min, max uint64, err error) {
+	if zs, ok := this.origin.(stores.ZoomStorer); ok {
+		return zs.Zooms(tileset)
+	}
+	err = stores.ErrNoItem
+	return
+}
+
+// Available implements the stores.AvailabilityStorer interface using the
+// origin.
+func (this *Store) Available(tileset string) ([][]stores.TileRange, error) {
+	if as, ok := this.origin.(stores.AvailabilityStorer); ok {
+		return as.Available(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// HashTile implements the stores.HashStorer interface using the origin.
+// Hashed tiles are not cached.
+func (this *Store) HashTile(tileset, hash string, tile *stores.Terrain) error {
+	if hs, ok := this.origin.(stores.HashStorer); ok {
+		return hs.HashTile(tileset, hash, tile)
+	}
+	return stores.ErrNoItem
+}
+
+// HashManifest implements the stores.HashStorer interface using the origin.
+func (this *Store) HashManifest(tileset string) ([]byte, error) {
+	if hs, ok := this.origin.(stores.HashStorer); ok {
+		return hs.HashManifest(tileset)
+	}
+	return nil, stores.ErrNoItem
+}
+
+// ResolveName implements the stores.NameResolver interface using the origin.
+func (this *Store) ResolveName(tileset string) (string, error) {
+	if nr, ok := this.origin.(stores.NameResolver); ok {
+		return nr.ResolveName(tileset)
+	}
+	return "", stores.ErrNoItem
+}
+
+// Describe implements the stores.Describer interface. The store is healthy if
+// the memcache servers respond to a request.
+func (this *Store) Describe() (desc stores.Description) {
+	desc.Type = this.String()
+	desc.Config = map[string]string{
+		"servers":    this.servers,
+		"chunk_size": strconv.Itoa(this.options.ChunkSize),
+		"chunking":   strconv.FormatBool(!this.options.NoChunking),
+		"touch":      strconv.FormatBool(this.options.Touch),
+	}
+
+	if _, err := this.mc.Get(this.options.Prefix + "cesium-terrain-server/health"); err != nil && err != memcache.ErrCacheMiss {
+		desc.Error = err.Error()
+	} else {
+		desc.Healthy = true
+	}
+	return
+}
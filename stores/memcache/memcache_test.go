@@ -0,0 +1,290 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The item size limit of the fake memcache server, as for memcached.
+const ITEM_LIMIT = 1024 * 1024
+
+// A fake memcache server speaking enough of the text protocol for the store.
+type fakeMemcache struct {
+	listener net.Listener
+
+	lock        sync.Mutex
+	items       map[string][]byte
+	flags       map[string]uint32
+	expirations map[string]int32
+}
+
+func newFakeMemcache(t *testing.T) *fakeMemcache {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	this := &fakeMemcache{
+		listener:    listener,
+		items:       make(map[string][]byte),
+		flags:       make(map[string]uint32),
+		expirations: make(map[string]int32),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go this.serve(conn)
+		}
+	}()
+	return this
+}
+
+func (this *fakeMemcache) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		this.lock.Lock()
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if value, ok := this.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s %d %d 1\r\n%s\r\n", key, this.flags[key], len(value), value)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			flags, _ := strconv.ParseUint(fields[2], 10, 32)
+			expiration, _ := strconv.ParseInt(fields[3], 10, 32)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err = io.ReadFull(rw, value); err != nil {
+				this.lock.Unlock()
+				return
+			}
+			if size > ITEM_LIMIT {
+				rw.WriteString("SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			this.items[fields[1]] = value[:size]
+			this.flags[fields[1]] = uint32(flags)
+			this.expirations[fields[1]] = int32(expiration)
+			rw.WriteString("STORED\r\n")
+		case "touch":
+			if _, ok := this.items[fields[1]]; ok {
+				expiration, _ := strconv.ParseInt(fields[2], 10, 32)
+				this.expirations[fields[1]] = int32(expiration)
+				rw.WriteString("TOUCHED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		this.lock.Unlock()
+
+		if err = rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (this *fakeMemcache) Close() {
+	this.listener.Close()
+}
+
+// Return the number of items cached.
+func (this *fakeMemcache) count() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.items)
+}
+
+// Return the expiration time an item was saved or touched with.
+func (this *fakeMemcache) expiration(key string) int32 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.expirations[key]
+}
+
+// An origin store holding a single tileset, counting the tiles it loads.
+type memoryStore struct {
+	tiles map[string][]byte
+	loads int
+}
+
+func (this *memoryStore) Tile(tileset string, tile *stores.Terrain) error {
+	value, ok := this.tiles[fmt.Sprintf("%s/%d/%d/%d", tileset, tile.Z, tile.X, tile.Y)]
+	if !ok {
+		return stores.ErrNoItem
+	}
+	this.loads++
+	tile.Encoding = "gzip"
+	return tile.UnmarshalBinary(value)
+}
+
+func (this *memoryStore) Layer(tileset string) ([]byte, error) {
+	return nil, stores.ErrNoItem
+}
+
+func (this *memoryStore) TilesetStatus(tileset string) stores.TilesetStatus {
+	return stores.FOUND
+}
+
+func TestChunking(t *testing.T) {
+	// Tiles either side of the chunk size and the server's item limit.
+	sizes := []int{
+		1024,
+		DEFAULT_CHUNK_SIZE,
+		DEFAULT_CHUNK_SIZE + 1,
+		ITEM_LIMIT + 1,
+		3*DEFAULT_CHUNK_SIZE + 17,
+	}
+
+	for _, noChunking := range []bool{false, true} {
+		for _, size := range sizes {
+			server := newFakeMemcache(t)
+
+			value := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(value)
+			origin := &memoryStore{tiles: map[string][]byte{"test/1/2/3": value}}
+			store := New(server.listener.Addr().String(), origin, Options{NoChunking: noChunking})
+
+			// The first load comes from the origin and is cached, unless
+			// it's too large to cache without chunking.
+			cached := size <= DEFAULT_CHUNK_SIZE || !noChunking
+			for i := 0; i < 2; i++ {
+				tile := stores.Terrain{X: 2, Y: 3, Z: 1}
+				if err := store.Tile("test", &tile); err != nil {
+					t.Fatalf("chunking %v, %d bytes: %s", !noChunking, size, err)
+				}
+				body, _ := tile.MarshalBinary()
+				if !bytes.Equal(body, value) {
+					t.Errorf("chunking %v, %d bytes, load %d: got %d bytes", !noChunking, size, i, len(body))
+				}
+				if tile.Encoding != "gzip" {
+					t.Errorf("chunking %v, %d bytes, load %d: got encoding %q", !noChunking, size, i, tile.Encoding)
+				}
+			}
+
+			loads := 1
+			if !cached {
+				loads = 2
+			}
+			if origin.loads != loads {
+				t.Errorf("chunking %v, %d bytes: the origin loaded the tile %d times, want %d", !noChunking, size, origin.loads, loads)
+			}
+
+			items := 0
+			if cached && size <= DEFAULT_CHUNK_SIZE {
+				items = 1
+			} else if cached {
+				items = 1 + (size+DEFAULT_CHUNK_SIZE-1)/DEFAULT_CHUNK_SIZE // the manifest and chunks
+			}
+			if count := server.count(); count != items {
+				t.Errorf("chunking %v, %d bytes: got %d cached items, want %d", !noChunking, size, count, items)
+			}
+
+			server.Close()
+		}
+	}
+}
+
+func TestItemExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		seconds, expiration int32
+	}{
+		{0, 0},
+		{60, 60},
+		{MAX_RELATIVE_EXPIRATION, MAX_RELATIVE_EXPIRATION},
+		{MAX_RELATIVE_EXPIRATION + 1, 1700000000 + MAX_RELATIVE_EXPIRATION + 1},
+		{365 * 24 * 60 * 60, 1700000000 + 365*24*60*60},
+		{1 << 30, 1<<31 - 1}, // beyond 2038
+	}
+
+	for _, test := range tests {
+		if expiration := itemExpiration(test.seconds, now); expiration != test.expiration {
+			t.Errorf("itemExpiration(%d): got %d, want %d", test.seconds, expiration, test.expiration)
+		}
+	}
+
+	// Long expiration times are sent to memcache as Unix times, including
+	// those of zoom level bands and the chunks of large tiles.
+	server := newFakeMemcache(t)
+	defer server.Close()
+
+	year := int32(365 * 24 * 60 * 60)
+	origin := &memoryStore{tiles: map[string][]byte{
+		"test/0/0/0": []byte("root"),
+		"test/9/0/0": make([]byte, ITEM_LIMIT+1),
+	}}
+	store := New(server.listener.Addr().String(), origin, Options{
+		Expiration: 2 * year,
+		Bands:      []ExpirationBand{{MinZoom: 0, MaxZoom: 5, Expiration: year}},
+	})
+
+	for _, tile := range []stores.Terrain{{Z: 0}, {Z: 9}} {
+		start := time.Now().Unix()
+		if err := store.Tile("test", &tile); err != nil {
+			t.Fatal(err)
+		}
+		end := time.Now().Unix()
+
+		ttl := int64(2 * year)
+		keys := []string{"test/9/0/0", "test/9/0/0#0", "test/9/0/0#1"}
+		if tile.Z == 0 {
+			ttl = int64(year)
+			keys = []string{"test/0/0/0"}
+		}
+		for _, key := range keys {
+			if expiration := int64(server.expiration(key)); expiration < start+ttl || expiration > end+ttl {
+				t.Errorf("%s: got expiration %d, want %d", key, expiration, start+ttl)
+			}
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	server := newFakeMemcache(t)
+	origin := &memoryStore{tiles: map[string][]byte{"test/0/0/0": []byte("root")}}
+	store := New(server.listener.Addr().String(), origin, Options{Timeout: 100 * time.Millisecond})
+	store.Monitor(10 * time.Millisecond)
+
+	// Once memcache is found to be down tiles come straight from the origin.
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	if store.health.Healthy() {
+		t.Fatal("memcache is reported healthy")
+	}
+
+	tile := stores.Terrain{}
+	if err := store.Tile("test", &tile); err != nil {
+		t.Fatal(err)
+	}
+	if len(tile.Timings) != 1 || tile.Timings[0].Store == store.String() {
+		t.Errorf("memcache was consulted: got timings %v", tile.Timings)
+	}
+}
@@ -0,0 +1,191 @@
+// Package object provides a store for tilesets held in an object store such
+// as Amazon S3 (or a compatible service e.g. MinIO or DigitalOcean Spaces).
+// Tilesets are laid out as in a tileset directory, tiles being the objects
+// `<prefix><tileset>/<z>/<x>/<y>.terrain`. The Store handles what all object
+// stores have in common, each service being supported by a Backend which
+// reads and writes single objects.
+package object
+
+import (
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The default number of idle connections kept open to the object store,
+// avoiding a new TLS handshake for each tile.
+const DEFAULT_MAX_IDLE_CONNS = 64
+
+// The default time limit on requests to the object store.
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+// Backend reads and writes objects in an object store.
+type Backend interface {
+	// Get returns the body of an object, or stores.ErrNoItem if it doesn't
+	// exist.
+	Get(key string) ([]byte, error)
+	// Put creates or replaces an object.
+	Put(key string, body []byte) error
+	// Exists returns true if any object has a key beginning with prefix.
+	Exists(prefix string) (bool, error)
+	// Config describes the backend, excluding credentials.
+	Config() map[string]string
+	String() string
+}
+
+// NewClient returns an HTTP client for backends to share, reusing connections
+// between requests. The timeout limits each request, DEFAULT_TIMEOUT if zero.
+func NewClient(maxIdleConns int, timeout time.Duration) *http.Client {
+	if maxIdleConns <= 0 {
+		maxIdleConns = DEFAULT_MAX_IDLE_CONNS
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			// Objects stored with a Content-Encoding of gzip must be
+			// returned as stored, not transparently decompressed.
+			DisableCompression: true,
+		},
+	}
+}
+
+// ResponseError returns the error corresponding to the status of a response
+// from an object store: stores.ErrNoItem for a missing object,
+// stores.ErrUnavailable for a server error or throttling so that clients can
+// retry, and nil for success. The body of failed responses is consumed so
+// that the connection can be reused.
+func ResponseError(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return stores.ErrNoItem
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		return stores.ErrUnavailable
+	}
+	return fmt.Errorf("%s %s: %s", res.Request.Method, res.Request.URL.Path, res.Status)
+}
+
+type Store struct {
+	backend Backend
+	prefix  string
+}
+
+// New returns a store reading tilesets from a backend. The prefix (e.g.
+// `tilesets/`) is prepended to object keys.
+func New(backend Backend, prefix string) *Store {
+	return &Store{
+		backend: backend,
+		prefix:  prefix,
+	}
+}
+
+func (this *Store) String() string {
+	return this.backend.String()
+}
+
+// Return the key of an object in a tileset, rejecting tileset names with
+// empty or relative segments.
+func (this *Store) key(tileset, name string) (key string, ok bool) {
+	for _, segment := range strings.Split(tileset, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return
+		}
+	}
+	return this.prefix + tileset + "/" + name, true
+}
+
+// Load a terrain tile from its object into the Terrain structure.
+func (this *Store) Tile(tileset string, tile *stores.Terrain) error {
+	key, ok := this.key(tileset, fmt.Sprintf("%d/%d/%d.terrain", tile.Z, tile.X, tile.Y))
+	if !ok {
+		return stores.ErrNoItem
+	}
+
+	body, err := this.backend.Get(key)
+	if err == stores.ErrNoItem {
+		log.Debug(fmt.Sprintf("%s store: not found: %s", this.backend, key))
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	log.Debug(fmt.Sprintf("%s store: load: %s", this.backend, key))
+	return tile.UnmarshalBinary(body)
+}
+
+// Save implements the stores.Saver interface, writing a tile to its object.
+func (this *Store) Save(tileset string, tile *stores.Terrain) error {
+	key, ok := this.key(tileset, fmt.Sprintf("%d/%d/%d.terrain", tile.Z, tile.X, tile.Y))
+	if !ok {
+		return fmt.Errorf("bad tileset name %s", tileset)
+	}
+
+	body, err := tile.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return this.backend.Put(key, body)
+}
+
+func (this *Store) Layer(tileset string) ([]byte, error) {
+	key, ok := this.key(tileset, "layer.json")
+	if !ok {
+		return nil, stores.ErrNoItem
+	}
+	return this.backend.Get(key)
+}
+
+// A tileset exists if there are objects within it.
+func (this *Store) TilesetStatus(tileset string) (status stores.TilesetStatus) {
+	key, ok := this.key(tileset, "")
+	if !ok {
+		return stores.NOT_FOUND
+	}
+
+	found, err := this.backend.Exists(key)
+	if err != nil {
+		log.Err(fmt.Sprintf("%s store: %s", this.backend, err))
+		return stores.NOT_SUPPORTED
+	} else if !found {
+		return stores.NOT_FOUND
+	}
+	return stores.FOUND
+}
+
+// Describe implements the stores.Describer interface. The store is healthy if
+// the backend can be queried.
+func (this *Store) Describe() (desc stores.Description) {
+	desc.Type = this.String()
+	desc.Config = this.backend.Config()
+	desc.Config["prefix"] = this.prefix
+
+	if _, err := this.backend.Exists(this.prefix); err != nil {
+		desc.Error = err.Error()
+	} else {
+		desc.Healthy = true
+	}
+	return
+}
@@ -0,0 +1,260 @@
+package object
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 is a Backend for Amazon S3 and compatible object stores. Requests are
+// signed with AWS Signature Version 4 if credentials are set, and are
+// otherwise anonymous, as for public buckets.
+type S3 struct {
+	Bucket string
+	Region string
+	// The url of the service, for S3 compatible stores e.g.
+	// `http://localhost:9000` for MinIO. Buckets are addressed in the path
+	// of the url. If empty the regional AWS endpoint is used.
+	Endpoint string
+
+	AccessKey, SecretKey, SessionToken string
+
+	Client *http.Client
+
+	slots chan struct{} // limits concurrent requests, if not nil
+}
+
+// NewS3 returns a backend for the bucket, reading credentials from the
+// standard AWS environment variables.
+func NewS3(bucket, region, endpoint string, client *http.Client) *S3 {
+	return &S3{
+		Bucket:       bucket,
+		Region:       region,
+		Endpoint:     endpoint,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       client,
+	}
+}
+
+func (this *S3) String() string {
+	return "s3"
+}
+
+// Limit caps the number of requests made to the service concurrently, e.g. to
+// avoid being throttled while filling a cache. Further requests wait until one
+// completes, i.e. until its response body is closed. Zero means unlimited.
+func (this *S3) Limit(max int) {
+	if max > 0 {
+		this.slots = make(chan struct{}, max)
+	} else {
+		this.slots = nil
+	}
+}
+
+// Wait for a free slot if concurrency is limited, returning the function
+// which frees it.
+func (this *S3) acquire() func() {
+	if this.slots == nil {
+		return func() {}
+	}
+
+	this.slots <- struct{}{}
+	return func() { <-this.slots }
+}
+
+// A response body which frees a request's slot when it is closed.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (this *slotBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.once.Do(this.release)
+	return err
+}
+
+// Config implements the Backend interface.
+func (this *S3) Config() map[string]string {
+	config := map[string]string{
+		"bucket": this.Bucket,
+		"region": this.Region,
+		"signed": fmt.Sprint(this.AccessKey != ""),
+	}
+	if this.slots != nil {
+		config["max_concurrent"] = strconv.Itoa(cap(this.slots))
+	}
+	if this.Endpoint != "" {
+		config["endpoint"] = this.Endpoint
+	}
+	return config
+}
+
+// Return the url of the bucket.
+func (this *S3) bucketUrl() string {
+	if this.Endpoint != "" {
+		return strings.TrimRight(this.Endpoint, "/") + "/" + this.Bucket
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", this.Bucket, this.Region)
+}
+
+// Escape an object key for use in a url path, as expected by the signature.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Make a signed request for an object (or the bucket if key is empty).
+func (this *S3) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := this.bucketUrl() + "/" + escapeKey(key)
+	if len(query) > 0 {
+		u += "?" + strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	release := this.acquire()
+	this.sign(req, body, time.Now().UTC())
+	res, err := this.Client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &slotBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign a request using AWS Signature Version 4.
+func (this *S3) sign(req *http.Request, body []byte, now time.Time) {
+	if this.AccessKey == "" {
+		return
+	}
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if this.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", this.SessionToken)
+	}
+
+	// The canonical headers are the host and the headers set above.
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := now.Format("20060102") + "/" + this.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+this.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, this.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		this.AccessKey, scope, signedHeaders, signature))
+}
+
+// Get implements the Backend interface.
+func (this *S3) Get(key string) ([]byte, error) {
+	res, err := this.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err = ResponseError(res); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Put implements the Backend interface.
+func (this *S3) Put(key string, body []byte) error {
+	res, err := this.do("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return ResponseError(res)
+}
+
+// Exists implements the Backend interface by listing at most one object with
+// the prefix.
+func (this *S3) Exists(prefix string) (bool, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"max-keys":  {"1"},
+		"prefix":    {prefix},
+	}
+	res, err := this.do("GET", "", query, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if err = ResponseError(res); err != nil {
+		return false, err
+	}
+
+	var result struct {
+		KeyCount int
+	}
+	if err = xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.KeyCount > 0, nil
+}
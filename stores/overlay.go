@@ -0,0 +1,334 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"strings"
+	"time"
+)
+
+// Overlay is a store composed of other stores in order of precedence. Each
+// tile and `layer.json` is served by the first store containing it, allowing
+// e.g. a small high detail tileset to overlay a global base tileset.
+type Overlay struct {
+	stores []Storer
+	health *healthMonitor // nil unless health checks are enabled
+
+	// If a store fails to load a tile, serve a stale copy of it from a
+	// store of higher precedence, if one exists, instead of failing.
+	ServeStale bool
+}
+
+func NewOverlay(stores ...Storer) *Overlay {
+	return &Overlay{
+		stores: stores,
+	}
+}
+
+// Stores returns the overlaid stores in order of precedence.
+func (this *Overlay) Stores() []Storer {
+	return this.stores
+}
+
+// Monitor checks the health of the stores at an interval. Unhealthy stores are
+// skipped until they recover: as they may contain the requested item,
+// ErrUnavailable is returned instead of ErrNoItem if a store was skipped.
+func (this *Overlay) Monitor(interval time.Duration) {
+	this.health = monitorHealth(this.stores, interval)
+}
+
+// Describe implements the Describer interface, reporting any stores which are
+// being skipped.
+func (this *Overlay) Describe() Description {
+	return this.health.describe("overlay", this.stores)
+}
+
+func (this *Overlay) String() string {
+	names := make([]string, len(this.stores))
+	for i, store := range this.stores {
+		names[i] = storeName(store)
+	}
+	return "overlay(" + strings.Join(names, ",") + ")"
+}
+
+// Return the error to use when no store has an item.
+func (this *Overlay) missing(skipped bool) error {
+	if skipped {
+		return ErrUnavailable
+	}
+	return ErrNoItem
+}
+
+func (this *Overlay) Tile(tileset string, tile *Terrain) error {
+	skipped := false
+	for i, store := range this.stores {
+		if !this.health.ok(i) {
+			skipped = true
+			continue
+		}
+
+		if err := timeTile(fmt.Sprintf("%s[%d]", storeName(store), i), store, tileset, tile); err == nil {
+			setSource(tile, this.stores, i)
+			return nil
+		} else if err != ErrNoItem {
+			return this.stale(i, tileset, tile, err)
+		}
+	}
+	return this.missing(skipped)
+}
+
+// Return the error with which the store at index failed to load a tile unless
+// a stale copy of the tile can be loaded from a preceding store.
+func (this *Overlay) stale(index int, tileset string, tile *Terrain, err error) error {
+	if !this.ServeStale || err == context.Canceled {
+		return err
+	}
+
+	for i, store := range this.stores[:index] {
+		ss, ok := store.(StaleStorer)
+		if !ok || !this.health.ok(i) {
+			continue
+		}
+
+		if ss.StaleTile(tileset, tile) == nil {
+			log.Notice(fmt.Sprintf("serving stale tile %s/%d/%d/%d from %s: %s", tileset, tile.Z, tile.X, tile.Y, storeName(store), err))
+			tile.Stale = true
+			setSource(tile, this.stores, i)
+			return nil
+		}
+	}
+	return err
+}
+
+// Stat implements the StatStorer interface, describing the tile in the first
+// store containing it. Stores which can't describe tiles are skipped.
+func (this *Overlay) Stat(tileset string, tile *Terrain) (*TileInfo, error) {
+	for _, store := range this.stores {
+		ss, ok := store.(StatStorer)
+		if !ok {
+			continue
+		}
+
+		if info, err := ss.Stat(tileset, tile); err != ErrNoItem {
+			return info, err
+		}
+	}
+	return nil, ErrNoItem
+}
+
+// HashTile implements the HashStorer interface, loading the tile from the
+// first store containing it. Stores without hashed tiles are skipped.
+func (this *Overlay) HashTile(tileset, hash string, tile *Terrain) error {
+	for i, store := range this.stores {
+		hs, ok := store.(HashStorer)
+		if !ok {
+			continue
+		}
+
+		if err := hs.HashTile(tileset, hash, tile); err != ErrNoItem {
+			if err == nil {
+				setSource(tile, this.stores, i)
+			}
+			return err
+		}
+	}
+	return ErrNoItem
+}
+
+// HashManifest implements the HashStorer interface, returning the manifest of
+// the first store with one.
+func (this *Overlay) HashManifest(tileset string) ([]byte, error) {
+	for _, store := range this.stores {
+		hs, ok := store.(HashStorer)
+		if !ok {
+			continue
+		}
+
+		if manifest, err := hs.HashManifest(tileset); err != ErrNoItem {
+			return manifest, err
+		}
+	}
+	return nil, ErrNoItem
+}
+
+// Tilesets implements the TilesetLister interface, listing the tilesets in any
+// of the stores.
+func (this *Overlay) Tilesets() ([]string, error) {
+	return listTilesets(this.stores)
+}
+
+// ResolveName implements the NameResolver interface, using the first store
+// which can resolve the name.
+func (this *Overlay) ResolveName(tileset string) (string, error) {
+	for _, store := range this.stores {
+		nr, ok := store.(NameResolver)
+		if !ok {
+			continue
+		}
+
+		if name, err := nr.ResolveName(tileset); err != ErrNoItem {
+			return name, err
+		}
+	}
+	return "", ErrNoItem
+}
+
+func (this *Overlay) Layer(tileset string) ([]byte, error) {
+	skipped := false
+	for i, store := range this.stores {
+		if !this.health.ok(i) {
+			skipped = true
+			continue
+		}
+
+		if layer, err := store.Layer(tileset); err != ErrNoItem {
+			return layer, err
+		}
+	}
+	return nil, this.missing(skipped)
+}
+
+// TilesetStatus returns FOUND if any of the stores contain the tileset.
+func (this *Overlay) TilesetStatus(tileset string) (status TilesetStatus) {
+	status = NOT_SUPPORTED
+	for _, store := range this.stores {
+		switch store.TilesetStatus(tileset) {
+		case FOUND:
+			return FOUND
+		case NOT_FOUND:
+			status = NOT_FOUND
+		}
+	}
+	return
+}
+
+// Return the stores which may contain a tileset.
+func (this *Overlay) holding(tileset string) (stores []Storer) {
+	for _, store := range this.stores {
+		if store.TilesetStatus(tileset) != NOT_FOUND {
+			stores = append(stores, store)
+		}
+	}
+	return
+}
+
+// Variants implements the VariantStorer interface, returning the media types
+// available from any of the stores, in order of precedence. Stores which can't
+// list their variants offer the default HEIGHTMAP_MEDIA_TYPE.
+func (this *Overlay) Variants(tileset string, tile *Terrain) ([]string, error) {
+	var variants []string
+	seen := make(map[string]bool)
+	for _, store := range this.stores {
+		types := []string{HEIGHTMAP_MEDIA_TYPE}
+		if vs, ok := store.(VariantStorer); ok {
+			var err error
+			if types, err = vs.Variants(tileset, tile); err == ErrNoItem {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, t := range types {
+			if !seen[t] {
+				seen[t] = true
+				variants = append(variants, t)
+			}
+		}
+	}
+	return variants, nil
+}
+
+// Coverage implements the CoverageStorer interface, combining the masks of the
+// stores which may contain the tileset. If any of them has no mask the
+// tileset's coverage is unrestricted and ErrNoItem is returned.
+func (this *Overlay) Coverage(tileset string) (*Coverage, error) {
+	var masks []*Coverage
+	for _, store := range this.holding(tileset) {
+		cs, ok := store.(CoverageStorer)
+		if !ok {
+			return nil, ErrNoItem
+		}
+
+		mask, err := cs.Coverage(tileset)
+		if err != nil {
+			return nil, err
+		}
+		masks = append(masks, mask)
+	}
+
+	if len(masks) == 0 {
+		return nil, ErrNoItem
+	}
+	return UnionCoverage(masks...), nil
+}
+
+// Available implements the AvailabilityStorer interface, combining the tiles
+// available in the stores which may contain the tileset. If any of them can't
+// determine its tiles ErrNoItem is returned.
+func (this *Overlay) Available(tileset string) ([][]TileRange, error) {
+	var available [][]TileRange
+	found := false
+	for _, store := range this.holding(tileset) {
+		as, ok := store.(AvailabilityStorer)
+		if !ok {
+			return nil, ErrNoItem
+		}
+
+		ranges, err := as.Available(tileset)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+
+		for z, r := range ranges {
+			if z >= len(available) {
+				available = append(available, make([][]TileRange, z+1-len(available))...)
+			}
+			available[z] = append(available[z], r...)
+		}
+	}
+
+	if !found {
+		return nil, ErrNoItem
+	}
+	for z := range available {
+		if available[z] == nil {
+			available[z] = []TileRange{} // listed as empty, not null
+		}
+	}
+	return available, nil
+}
+
+// Zooms implements the ZoomStorer interface, returning the combined zoom
+// extent of the stores which can report it.
+func (this *Overlay) Zooms(tileset string) (min, max uint64, err error) {
+	found := false
+	for _, store := range this.stores {
+		zs, ok := store.(ZoomStorer)
+		if !ok {
+			continue
+		}
+
+		lo, hi, err := zs.Zooms(tileset)
+		if err == ErrNoItem {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		if !found || lo < min {
+			min = lo
+		}
+		if !found || hi > max {
+			max = hi
+		}
+		found = true
+	}
+
+	if !found {
+		err = ErrNoItem
+	}
+	return
+}
@@ -0,0 +1,138 @@
+// Package postgres provides a store for tiles held in a PostgreSQL (e.g.
+// PostGIS) table with the columns `tileset`, `z`, `x`, `y` and `body`, the
+// body being the gzipped tile. Saving tiles requires a unique constraint on
+// (tileset, z, x, y). Tilesets have no layer.json so a default one is served.
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"github.com/geo-data/cesium-terrain-server/stores"
+	"regexp"
+	"strconv"
+)
+
+// The table queried if none is given.
+const DEFAULT_TABLE = "tiles"
+
+// Table names are interpolated into queries so they are restricted to
+// (optionally schema qualified) SQL identifiers.
+var tablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidateTable checks that a table name can be queried.
+func ValidateTable(table string) error {
+	if !tablePattern.MatchString(table) {
+		return fmt.Errorf("bad table name %s: expected an identifier optionally qualified by a schema e.g. terrain.tiles", table)
+	}
+	return nil
+}
+
+type Store struct {
+	db    *sql.DB
+	table string
+
+	tileQuery, saveQuery, statusQuery, listQuery string
+}
+
+// New returns a store reading tiles from a table using the connection pool
+// db. The table name must pass ValidateTable.
+func New(db *sql.DB, table string) *Store {
+	return &Store{
+		db:    db,
+		table: table,
+
+		tileQuery: fmt.Sprintf("SELECT body FROM %s WHERE tileset=$1 AND z=$2 AND x=$3 AND y=$4", table),
+		saveQuery: fmt.Sprintf("INSERT INTO %s (tileset, z, x, y, body) VALUES ($1, $2, $3, $4, $5) "+
+			"ON CONFLICT (tileset, z, x, y) DO UPDATE SET body = EXCLUDED.body", table),
+		statusQuery: fmt.Sprintf("SELECT 1 FROM %s WHERE tileset=$1 LIMIT 1", table),
+		listQuery:   fmt.Sprintf("SELECT DISTINCT tileset FROM %s ORDER BY tileset", table),
+	}
+}
+
+func (this *Store) String() string {
+	return "postgres"
+}
+
+// Load a terrain tile from the table into the Terrain structure.
+func (this *Store) Tile(tileset string, tile *stores.Terrain) error {
+	var body []byte
+	err := this.db.QueryRow(this.tileQuery, tileset, int64(tile.Z), int64(tile.X), int64(tile.Y)).Scan(&body)
+	if err == sql.ErrNoRows {
+		log.Debug(fmt.Sprintf("postgres store: not found: %s/%d/%d/%d", tileset, tile.Z, tile.X, tile.Y))
+		return stores.ErrNoItem
+	} else if err != nil {
+		return err
+	}
+
+	log.Debug(fmt.Sprintf("postgres store: load: %s/%d/%d/%d", tileset, tile.Z, tile.X, tile.Y))
+	return tile.UnmarshalBinary(body)
+}
+
+// Save implements the stores.Saver interface, inserting the tile or replacing
+// an existing copy.
+func (this *Store) Save(tileset string, tile *stores.Terrain) error {
+	body, err := tile.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = this.db.Exec(this.saveQuery, tileset, int64(tile.Z), int64(tile.X), int64(tile.Y), body)
+	return err
+}
+
+// The table holds no layer.json so a default is always served.
+func (this *Store) Layer(tileset string) ([]byte, error) {
+	return nil, stores.ErrNoItem
+}
+
+// A tileset exists if the table holds any of its tiles.
+func (this *Store) TilesetStatus(tileset string) (status stores.TilesetStatus) {
+	var found int
+	err := this.db.QueryRow(this.statusQuery, tileset).Scan(&found)
+	if err == sql.ErrNoRows {
+		return stores.NOT_FOUND
+	} else if err != nil {
+		log.Err(fmt.Sprintf("postgres store: %s", err))
+		return stores.NOT_SUPPORTED
+	}
+	return stores.FOUND
+}
+
+// Tilesets implements the stores.TilesetLister interface.
+func (this *Store) Tilesets() ([]string, error) {
+	rows, err := this.db.Query(this.listQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tilesets []string
+	for rows.Next() {
+		var tileset string
+		if err = rows.Scan(&tileset); err != nil {
+			return nil, err
+		}
+		tilesets = append(tilesets, tileset)
+	}
+	return tilesets, rows.Err()
+}
+
+// Describe implements the stores.Describer interface. The connection string
+// is omitted as it may contain a password.
+func (this *Store) Describe() (desc stores.Description) {
+	stats := this.db.Stats()
+	desc.Type = this.String()
+	desc.Config = map[string]string{
+		"table":            this.table,
+		"open_connections": strconv.Itoa(stats.OpenConnections),
+		"max_connections":  strconv.Itoa(stats.MaxOpenConnections),
+	}
+
+	if err := this.db.Ping(); err != nil {
+		desc.Error = err.Error()
+	} else {
+		desc.Healthy = true
+	}
+	return
+}
@@ -2,6 +2,9 @@ package stores
 
 import (
 	"errors"
+	"os"
+	"sort"
+	"time"
 )
 
 type TilesetStatus byte
@@ -12,10 +15,155 @@ const (
 	FOUND
 )
 
+// Media types identifying the terrain formats understood by Cesium.
+const (
+	HEIGHTMAP_MEDIA_TYPE      = "application/octet-stream"
+	QUANTIZED_MESH_MEDIA_TYPE = "application/vnd.quantized-mesh"
+)
+
 var ErrNoItem = errors.New("item not found")
 
+// ErrUnavailable is returned when a store cannot currently be read from, for
+// instance after retrying a transient failure.
+var ErrUnavailable = errors.New("store temporarily unavailable")
+
 type Storer interface {
 	Tile(tileset string, tile *Terrain) error
 	Layer(tileset string) ([]byte, error)
 	TilesetStatus(tileset string) (status TilesetStatus)
 }
+
+// VariantStorer is implemented by stores that can supply a tile in more than
+// one representation. Variants returns the media types available for the
+// tile in order of preference: the chosen media type is assigned to the
+// tile's MediaType before it is passed to Tile.
+type VariantStorer interface {
+	Storer
+	Variants(tileset string, tile *Terrain) ([]string, error)
+}
+
+// Saver is implemented by stores to which tiles can be written, e.g. to
+// populate a local store from a remote one. Saving a tile must be safe when
+// called concurrently for the same tile.
+type Saver interface {
+	Storer
+	Save(tileset string, tile *Terrain) error
+}
+
+// StaleStorer is implemented by stores which treat old tiles as missing (e.g.
+// the fs store's MaxAge). StaleTile loads a tile regardless of its age, so that
+// a stale tile can be served when a fresher copy can't be read.
+type StaleStorer interface {
+	Storer
+	StaleTile(tileset string, tile *Terrain) error
+}
+
+// FileStorer is implemented by stores which keep each tile in a file. TileFile
+// opens the file, allowing the tile to be streamed to clients (e.g. with
+// sendfile) without reading it into memory. The caller closes the file.
+type FileStorer interface {
+	Storer
+	TileFile(tileset string, tile *Terrain) (*os.File, error)
+}
+
+// TilesetLister is implemented by stores which can enumerate their tilesets.
+// Tileset names are returned in sorted order.
+type TilesetLister interface {
+	Storer
+	Tilesets() ([]string, error)
+}
+
+// NameResolver is implemented by stores which can find a tileset whose name
+// differs from a requested name only in case. The name of the tileset in the
+// store is returned, or ErrNoItem if there is no such tileset.
+type NameResolver interface {
+	Storer
+	ResolveName(tileset string) (string, error)
+}
+
+// TileInfo describes a tile in a store without its content.
+type TileInfo struct {
+	Store    string    // the name of the store holding the tile
+	Size     int64     // the size of the tile in bytes
+	Encoding string    // the content encoding, if known
+	Modified time.Time // the time the tile was last modified, if known
+}
+
+// StatStorer is implemented by stores which can describe a tile more cheaply
+// than loading it. ErrNoItem is returned if the tile doesn't exist.
+type StatStorer interface {
+	Storer
+	Stat(tileset string, tile *Terrain) (*TileInfo, error)
+}
+
+// HashStorer is implemented by stores which can load tiles by the hex MD5
+// digest of their content, allowing tiles to be served at immutable urls. The
+// manifest lists the digest of each tile in a tileset. ErrNoItem is returned
+// if a tile or manifest doesn't exist.
+type HashStorer interface {
+	Storer
+	HashTile(tileset, hash string, tile *Terrain) error
+	HashManifest(tileset string) ([]byte, error)
+}
+
+// CacheStats reports the use of a bounded cache of tiles.
+type CacheStats struct {
+	Size    int64 // the total size of the cached tiles in bytes
+	MaxSize int64 // the size beyond which tiles are evicted
+	Entries int64 // the number of cached tiles
+	Hits    uint64
+	Misses  uint64
+}
+
+// CacheStatter is implemented by bounded caches of tiles, such as stores
+// caching the tiles of another store.
+type CacheStatter interface {
+	CacheStats() CacheStats
+}
+
+// Description reports the configuration and health of a store for
+// diagnostic purposes.
+type Description struct {
+	Type    string            `json:"type"`
+	Config  map[string]string `json:"config,omitempty"`
+	Healthy bool              `json:"healthy"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Describer is implemented by stores which can describe themselves.
+type Describer interface {
+	Describe() Description
+}
+
+// HealthMonitor is implemented by stores which can check the health of the
+// stores they are composed of, or of the cache they hold, at an interval.
+// Unhealthy stores and caches are skipped until they recover.
+type HealthMonitor interface {
+	Monitor(interval time.Duration)
+}
+
+// Return the sorted union of the tilesets in the stores which can list them.
+func listTilesets(list []Storer) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, store := range list {
+		tl, ok := store.(TilesetLister)
+		if !ok {
+			continue
+		}
+
+		tilesets, err := tl.Tilesets()
+		if err != nil {
+			return nil, err
+		}
+		for _, tileset := range tilesets {
+			seen[tileset] = true
+		}
+	}
+
+	tilesets := make([]string, 0, len(seen))
+	for tileset := range seen {
+		tilesets = append(tilesets, tileset)
+	}
+	sort.Strings(tilesets)
+	return tilesets, nil
+}
@@ -1,14 +1,66 @@
 package stores
 
 import (
+	"crypto/md5"
 	"strconv"
+	"time"
 )
 
+// The highest zoom level accepted where tile ranges are computed from a zoom
+// level, keeping the number of rows and columns well within 64 bits. Tiles at
+// this level are a few centimetres across.
+const MAX_ZOOM = 30
+
 // Representation of a terrain tile. This includes the x, y, z coordinate and
-// the byte sequence of the tile itself. Note that terrain tiles are gzipped.
+// the byte sequence of the tile itself. Note that terrain tiles are normally
+// gzipped.
 type Terrain struct {
-	value   []byte
-	X, Y, Z uint64
+	value     []byte
+	X, Y, Z   uint64
+	MediaType string // the representation of the tile e.g. HEIGHTMAP_MEDIA_TYPE
+	Encoding  string // the content encoding of the byte sequence, if known
+
+	// Precompressed content encodings acceptable to the client in order of
+	// preference e.g. `br`. Stores may use these to select a variant.
+	AcceptEncodings []string
+
+	// Set by stores serving an out of date tile because the current tile
+	// couldn't be read.
+	Stale bool
+
+	// The store which loaded the tile, recorded by stores composed of other
+	// stores e.g. `fs[1]` for the second store of an overlay.
+	Source string
+
+	// The durations of the lookups made in each store to load the tile,
+	// recorded by stores composed of other stores (see TimeTile).
+	Timings []Timing
+
+	md5 []byte // the digest of value, if known
+}
+
+// Timing records the duration of a lookup in a store.
+type Timing struct {
+	Store    string // e.g. `fs[1]` for the second store of an overlay
+	Duration time.Duration
+}
+
+// TimeTile loads a tile from a store, recording the duration of the lookup in
+// the tile's Timings. Stores which record timings of their own (i.e. those
+// composed of other stores) are left to do so, so that each store a lookup
+// reaches is timed once.
+func TimeTile(store Storer, tileset string, tile *Terrain) error {
+	return timeTile(storeName(store), store, tileset, tile)
+}
+
+func timeTile(name string, store Storer, tileset string, tile *Terrain) error {
+	count := len(tile.Timings)
+	start := time.Now()
+	err := store.Tile(tileset, tile)
+	if len(tile.Timings) == count {
+		tile.Timings = append(tile.Timings, Timing{name, time.Since(start)})
+	}
+	return err
 }
 
 // MarshalBinary implements the encoding.MarshalBinary interface.
@@ -19,9 +71,20 @@ func (this *Terrain) MarshalBinary() ([]byte, error) {
 // UnmarshalBinary implements the encoding.UnmarshalBinary interface.
 func (this *Terrain) UnmarshalBinary(data []byte) error {
 	this.value = data
+	this.md5 = nil
 	return nil
 }
 
+// MD5 returns the MD5 digest of the tile's byte sequence. The digest is
+// calculated on first use and kept until the byte sequence changes.
+func (this *Terrain) MD5() []byte {
+	if this.md5 == nil {
+		sum := md5.Sum(this.value)
+		this.md5 = sum[:]
+	}
+	return this.md5
+}
+
 // IsRoot returns true if the tile represents a root tile.
 func (self *Terrain) IsRoot() bool {
 	return self.Z == 0 &&
@@ -0,0 +1,191 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/geo-data/cesium-terrain-server/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spans are exported in batches of up to BATCH_SIZE spans, at least every
+// EXPORT_INTERVAL. Up to MAX_QUEUED spans await export: further spans are
+// dropped until the collector catches up.
+const (
+	BATCH_SIZE      = 512
+	EXPORT_INTERVAL = 5 * time.Second
+	MAX_QUEUED      = 4096
+)
+
+// Tracer exports spans to an OpenTelemetry collector.
+type Tracer struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *Span
+}
+
+// NewTracer returns a tracer exporting spans to the OTLP/HTTP endpoint of a
+// collector e.g. `http://localhost:4318`, attributed to the named service.
+func NewTracer(endpoint, service string) *Tracer {
+	this := &Tracer{
+		url:     strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *Span, MAX_QUEUED),
+	}
+	go this.run()
+	return this
+}
+
+// Queue a finished span for export.
+func (this *Tracer) queue(span *Span) {
+	select {
+	case this.spans <- span:
+	default: // the queue is full
+	}
+}
+
+// Export spans as they are queued.
+func (this *Tracer) run() {
+	ticker := time.NewTicker(EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-this.spans:
+			if batch = append(batch, span); len(batch) < BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := this.export(batch); err != nil {
+			log.Err(fmt.Sprintf("cannot export %d trace spans: %s", len(batch), err))
+		}
+		batch = nil
+	}
+}
+
+// The OTLP JSON encoding of spans.
+type (
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// Encode attributes in a stable order.
+func attributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encoded := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		encoded[i] = otlpAttribute{key, otlpValue{attrs[key]}}
+	}
+	return encoded
+}
+
+func encodeSpan(span *Span) otlpSpan {
+	span.lock.Lock()
+	defer span.lock.Unlock()
+
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(span.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.SpanID[:]),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        attributes(span.Attributes),
+	}
+
+	if span.ParentID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+	}
+
+	if span.Error != "" {
+		encoded.Status = otlpStatus{Code: 2, Message: span.Error} // STATUS_CODE_ERROR
+	}
+	return encoded
+}
+
+// Send a batch of spans to the collector.
+func (this *Tracer) export(batch []*Span) error {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, len(batch))}
+	scope.Scope.Name = this.service
+	for i, span := range batch {
+		scope.Spans[i] = encodeSpan(span)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = attributes(map[string]string{"service.name": this.service})
+
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+
+	res, err := this.client.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", this.url, res.Status)
+	}
+	return nil
+}
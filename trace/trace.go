@@ -0,0 +1,181 @@
+// Package trace records spans describing how requests are served, exporting
+// them to an OpenTelemetry collector using the OTLP/HTTP JSON protocol.
+// Incoming W3C `traceparent` headers are honoured so that requests appear
+// within the traces of the applications making them.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as defined by OpenTelemetry.
+const (
+	KIND_INTERNAL = 1
+	KIND_SERVER   = 2
+)
+
+// Span records a single operation within a trace.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // zero if the span is the root of the trace
+	Name       string
+	Kind       int
+	Start, End time.Time
+	Attributes map[string]string
+	Error      string // the error message if the operation failed
+
+	tracer *Tracer
+	lock   sync.Mutex
+}
+
+type spanKey struct{}
+
+// FromContext returns the span recorded in a context, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span as a child of the span in the context. If there is no
+// span in the context the request is not being traced and nil is returned:
+// the methods of a nil span do nothing, so callers needn't check.
+func Start(ctx context.Context, name string) *Span {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+
+	span := &Span{
+		TraceID:    parent.TraceID,
+		ParentID:   parent.SpanID,
+		Name:       name,
+		Kind:       KIND_INTERNAL,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     parent.tracer,
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// SetAttribute annotates the span.
+func (this *Span) SetAttribute(key, value string) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	this.Attributes[key] = value
+	this.lock.Unlock()
+}
+
+// Finish ends the span, recording the error (if any) with which the operation
+// failed, and queues it for export.
+func (this *Span) Finish(err error) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	this.End = time.Now()
+	if err != nil {
+		this.Error = err.Error()
+	}
+	this.lock.Unlock()
+
+	this.tracer.queue(this)
+}
+
+// Parse a W3C `traceparent` header of the form
+// `00-<trace id>-<parent id>-<flags>`.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+
+	// check the lengths first: hex.Decode doesn't bound the destination
+	if len(parts[1]) != 2*len(traceID) || len(parts[2]) != 2*len(parentID) {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return
+	}
+
+	ok = traceID != [16]byte{} && parentID != [8]byte{}
+	return
+}
+
+// Records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusWriter) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+	}
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *statusWriter) Write(buf []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.ResponseWriter.Write(buf)
+}
+
+func (this *statusWriter) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware returns HTTP middleware which records a root span for each
+// request, continuing the trace identified by the request's `traceparent`
+// header if present. Handlers add child spans using Start.
+func (this *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := &Span{
+			Name:  r.Method,
+			Kind:  KIND_SERVER,
+			Start: time.Now(),
+			Attributes: map[string]string{
+				"http.method": r.Method,
+				"http.target": r.URL.RequestURI(),
+			},
+			tracer: this,
+		}
+
+		var ok bool
+		if span.TraceID, span.ParentID, ok = parseTraceparent(r.Header.Get("traceparent")); !ok {
+			span.ParentID = [8]byte{}
+			rand.Read(span.TraceID[:])
+		}
+		rand.Read(span.SpanID[:])
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, span)))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", strconv.Itoa(sw.status))
+		if sw.status >= 500 {
+			span.Error = http.StatusText(sw.status)
+		}
+		span.Finish(nil)
+	})
+}
@@ -0,0 +1,43 @@
+package trace
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-" + traceID + "-" + parentID + "-01", true},
+		{" 00-" + traceID + "-" + parentID + "-01 ", true},
+		{"", false},
+		{"00-" + traceID + "-" + parentID, false},
+		{"ff-" + traceID + "-" + parentID + "-01", false},
+		{"00-" + traceID + "00-" + parentID + "-01", false},
+		{"00-" + traceID + strings.Repeat("a", 100) + "-" + parentID + "-01", false},
+		{"00-" + traceID + "-" + parentID + "0000-01", false},
+		{"00-" + traceID[:30] + "-" + parentID + "-01", false},
+		{"00-" + strings.Repeat("z", 32) + "-" + parentID + "-01", false},
+		{"00-" + strings.Repeat("0", 32) + "-" + parentID + "-01", false},
+		{"00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+	}
+
+	for _, test := range tests {
+		tid, pid, ok := parseTraceparent(test.header)
+		if ok != test.ok {
+			t.Errorf("parseTraceparent(%q): got ok %v, want %v", test.header, ok, test.ok)
+			continue
+		}
+		if ok && (hex.EncodeToString(tid[:]) != traceID || hex.EncodeToString(pid[:]) != parentID) {
+			t.Errorf("parseTraceparent(%q): got %x-%x", test.header, tid, pid)
+		}
+	}
+}